@@ -0,0 +1,176 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"s3pool/lander"
+)
+
+// A cached object is the unit of eviction. It consists of the source
+// file and its meta file under data/, plus the outputs that lander
+// produced for it on the devices (.zmp, .list, .schema and the xrg
+// segment files). In local mode the source file belongs to the user
+// and is never part of the unit.
+
+func mapToPath(bucket, key string) (path string, err error) {
+	path, err = filepath.Abs(fmt.Sprintf("data/%s/%s", bucket, key))
+	return
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Return all existing files that belong to (bucket, key)
+func Files(bucket, key string) (files []string) {
+	path, err := mapToPath(bucket, key)
+	if err != nil {
+		return
+	}
+
+	if conf.BucketDfsMode(bucket) != conf.DFS_LOCAL && fileExists(path) {
+		files = append(files, path)
+	}
+	if fileExists(path + "__meta__") {
+		files = append(files, path+"__meta__")
+	}
+	if zmppath, err := lander.FindZMPFile(bucket, key); err == nil {
+		files = append(files, lander.XrgFiles(zmppath)...)
+	}
+	return
+}
+
+// Remove all files that belong to (bucket, key). The lander outputs
+// go first and the source file last, so that an interrupted removal
+// never leaves a conversion without its source. Caller should hold
+// the strlock on "bucket:key".
+func Remove(bucket, key string) error {
+	path, err := mapToPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	if zmppath, err := lander.FindZMPFile(bucket, key); err == nil {
+		if err = lander.RemoveXrgFile(zmppath); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(path + "__meta__"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if conf.BucketDfsMode(bucket) != conf.DFS_LOCAL {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	Forget(bucket, key)
+	return nil
+}
+
+// Make fname the cached object of (bucket, key) once it has been
+// pushed to the backend, with meta as its meta file. The file is
+// copied to data/ unless it is the cached object already, in which
+// case its lander outputs are kept too. In local mode fname is the
+// source file and only the meta file is written. Caller should hold
+// the strlock on "bucket:key".
+func Keep(bucket, key, fname string, meta []byte) error {
+	path, err := mapToPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	local := conf.BucketDfsMode(bucket) == conf.DFS_LOCAL
+	fi, ferr := os.Stat(fname)
+	di, derr := os.Stat(path)
+	cached := !local && ferr == nil && derr == nil && os.SameFile(fi, di)
+	if !cached {
+		if err = Remove(bucket, key); err != nil {
+			return err
+		}
+	}
+	if !cached && !local {
+		if err = copyFile(fname, path); err != nil {
+			return err
+		}
+	}
+
+	// write the meta file last, so that it is never there without
+	// the source it describes
+	if err = writeFile(path+"__meta__", meta); err != nil {
+		os.Remove(path + "__meta__")
+		return err
+	}
+	Add(bucket, key)
+	return nil
+}
+
+// Copy src to dst through a temp file in tmp/, creating the dst's dir
+// if necessary
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fp, err := ioutil.TempFile("tmp", "keep_")
+	if err != nil {
+		return fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	defer os.Remove(fp.Name())
+	_, err = io.Copy(fp, in)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot copy %s -- %v", src, err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("Cannot mkdir %s -- %v", filepath.Dir(dst), err)
+	}
+	if err = os.Rename(fp.Name(), dst); err != nil {
+		return fmt.Errorf("Cannot mv file -- %v", err)
+	}
+	return nil
+}
+
+// Write byt to path through a temp file in tmp/
+func writeFile(path string, byt []byte) error {
+	fp, err := ioutil.TempFile("tmp", "keep_")
+	if err != nil {
+		return fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	defer os.Remove(fp.Name())
+	_, err = fp.Write(byt)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Cannot mkdir %s -- %v", filepath.Dir(path), err)
+	}
+	return os.Rename(fp.Name(), path)
+}
@@ -0,0 +1,169 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type checkpointHeader struct {
+	Devices []string
+}
+
+type checkpointRecord struct {
+	B string  // bucket
+	K string  // key
+	S []int64 // bytes on each device
+	A int64   // atime in unix nanoseconds
+	H int64   // hits
+}
+
+// serializes writers of the checkpoint file
+var checkpointMux sync.Mutex
+
+// Write the index to the checkpoint file
+func Checkpoint() error {
+	checkpointMux.Lock()
+	defer checkpointMux.Unlock()
+
+	mux.Lock()
+	recs := make([]checkpointRecord, 0, len(entries))
+	for _, e := range entries {
+		recs = append(recs, checkpointRecord{e.Bucket, e.Key, e.Bytes, e.Atime.UnixNano(), e.Hits})
+	}
+	mux.Unlock()
+
+	tmppath := CHECKPOINT + ".tmp"
+	fp, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	enc := json.NewEncoder(w)
+	enc.Encode(checkpointHeader{devices})
+	for i := range recs {
+		if err = enc.Encode(&recs[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	return os.Rename(tmppath, CHECKPOINT)
+}
+
+func load() error {
+	fp, err := os.Open(CHECKPOINT)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(fp))
+	var hdr checkpointHeader
+	if err = dec.Decode(&hdr); err != nil {
+		return err
+	}
+	// if the devices changed, the sizes must be measured again
+	remeasure := !reflect.DeepEqual(hdr.Devices, devices)
+
+	mux.Lock()
+	defer mux.Unlock()
+	for dec.More() {
+		var rec checkpointRecord
+		if err = dec.Decode(&rec); err != nil {
+			return err
+		}
+		e := &Entry{Bucket: rec.B, Key: rec.K, Bytes: rec.S, Atime: time.Unix(0, rec.A), Hits: rec.H}
+		if remeasure || len(e.Bytes) != len(devices) {
+			e.Bytes = measure(e.Bucket, e.Key)
+		}
+		insert(e)
+	}
+	return nil
+}
+
+// Walk data/ and add objects that are missing in the index; drop the
+// entries whose meta file is gone. An object is known by its meta
+// file; in local mode that is all there is in data/.
+func reconcile() (added int, err error) {
+	start := time.Now()
+	seen := make(map[string]bool)
+	err = filepath.Walk("data", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, "__meta__") {
+			return nil
+		}
+		rel := strings.TrimSuffix(strings.TrimPrefix(path, "data/"), "__meta__")
+		nv := strings.SplitN(rel, "/", 2)
+		if len(nv) != 2 {
+			return nil
+		}
+		bucket, key := nv[0], nv[1]
+		seen[entryName(bucket, key)] = true
+
+		mux.Lock()
+		e := entries[entryName(bucket, key)]
+		mux.Unlock()
+		if e != nil {
+			return nil
+		}
+
+		// the access time of the source file tells when it was last pulled
+		atimeOf := path
+		if st, err := os.Stat(strings.TrimSuffix(path, "__meta__")); err == nil && !st.IsDir() {
+			atimeOf = strings.TrimSuffix(path, "__meta__")
+		}
+		var atime time.Time
+		if st, err := os.Stat(atimeOf); err == nil {
+			stat := st.Sys().(*syscall.Stat_t)
+			atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+		}
+
+		e = &Entry{Bucket: bucket, Key: key, Bytes: measure(bucket, key), Atime: atime}
+		mux.Lock()
+		if entries[entryName(bucket, key)] == nil {
+			insert(e)
+			added++
+		}
+		mux.Unlock()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	mux.Lock()
+	for name, e := range entries {
+		if !seen[name] && e.Atime.Before(start) {
+			drop(e)
+		}
+	}
+	mux.Unlock()
+	return
+}
@@ -0,0 +1,330 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"s3pool/lander"
+	"s3pool/strlock"
+	"strings"
+	"time"
+)
+
+// Fsck checks that the files on disk make up whole cached objects:
+//
+//   - a temp file in tmp/ is left over from a download that died;
+//   - a source file in data/ needs its meta file, and a meta file
+//     needs its source file except in local mode;
+//   - a .zmp file needs its .schema file and the segment files named
+//     in its .list file, and a cached object to belong to;
+//   - a .list or .schema file, or a segment file, needs a .zmp file.
+//
+// A broken object is removed as a whole so that the next PULL fetches
+// it again. Objects locked by a PULL in progress are skipped, and so
+// are stray files written since s3pool started and touched in the last
+// STALE, which may still be in use.
+
+const STALE = time.Hour
+
+// prefixes of the temp files of the backends
+var tmpPrefixes = []string{"s3f_", "s3p_", "dfs_", "gcsf_", "keep_"}
+
+// One inconsistency found by Fsck
+type Problem struct {
+	Action string // found, removed or failed
+	Path   string // a file, or bucket:key for a cached object
+	Reason string
+}
+
+type fsck struct {
+	repair   bool
+	ctx      context.Context
+	seen     map[string]bool // objects reported
+	problems []Problem
+}
+
+// Check the files of the cache, and remove the broken ones if repair.
+// Returns what was found.
+func Fsck(repair bool) []Problem {
+	f := &fsck{
+		repair: repair,
+		ctx:    strlock.WithOwner(context.Background(), "fsck"),
+		seen:   make(map[string]bool),
+	}
+	f.tmp()
+	f.data()
+	for _, dev := range lander.Devices() {
+		f.device(dev)
+	}
+	f.index()
+	return f.problems
+}
+
+func stale(fi os.FileInfo) bool {
+	return fi.ModTime().Before(conf.UpSince) || time.Since(fi.ModTime()) > STALE
+}
+
+func (f *fsck) report(path, reason string, remove func() error) {
+	action := "found"
+	if f.repair {
+		action = "removed"
+		if err := remove(); err != nil {
+			action = "failed"
+			reason += " -- " + err.Error()
+		}
+	}
+	f.problems = append(f.problems, Problem{action, path, reason})
+}
+
+// Report bucket:key as broken if bad() holds once the object is
+// locked, and remove it if repair
+func (f *fsck) object(bucket, key, reason string, bad func() bool) {
+	name := entryName(bucket, key)
+	if f.seen[name] {
+		return
+	}
+
+	lockname, err := strlock.TryLock(f.ctx, bucket+":"+key)
+	if err != nil {
+		// being pulled
+		return
+	}
+	defer strlock.Unlock(lockname)
+	if !bad() {
+		return
+	}
+	f.seen[name] = true
+	f.report(name, reason, func() error {
+		return Remove(bucket, key)
+	})
+}
+
+func (f *fsck) tmp() {
+	infos, err := ioutil.ReadDir("tmp")
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		for _, prefix := range tmpPrefixes {
+			if !fi.IsDir() && strings.HasPrefix(fi.Name(), prefix) && stale(fi) {
+				path := filepath.Join("tmp", fi.Name())
+				f.report(path, "temp file left over", func() error {
+					return os.Remove(path)
+				})
+				break
+			}
+		}
+	}
+}
+
+func (f *fsck) data() {
+	filepath.Walk("data", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		rel := strings.TrimSuffix(strings.TrimPrefix(path, "data/"), "__meta__")
+		nv := strings.SplitN(rel, "/", 2)
+		if len(nv) != 2 {
+			return nil
+		}
+		bucket, key := nv[0], nv[1]
+		src := filepath.Join("data", rel)
+
+		if strings.HasSuffix(path, "__meta__") {
+			if conf.BucketDfsMode(bucket) == conf.DFS_LOCAL {
+				return nil
+			}
+			f.object(bucket, key, "meta file without source file", func() bool {
+				return fileExists(path) && !fileExists(src)
+			})
+		} else {
+			f.object(bucket, key, "source file without meta file", func() bool {
+				return fileExists(path) && !fileExists(path+"__meta__")
+			})
+		}
+		return nil
+	})
+}
+
+// Return the keys of the cached objects whose xrg outputs are stem in
+// dir of bucket, judged by their meta files
+func keysOfStem(bucket, dir, stem string) (keys []string) {
+	infos, err := ioutil.ReadDir(filepath.Join("data", bucket, dir))
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasSuffix(name, "__meta__") {
+			name = strings.TrimSuffix(name, "__meta__")
+			if lander.Stem(name) == stem {
+				keys = append(keys, filepath.Join(dir, name))
+			}
+		}
+	}
+	return
+}
+
+// Return the segment files named in the .list file lstpath
+func segments(lstpath string) (flist []string, err error) {
+	byt, err := ioutil.ReadFile(lstpath)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(byt, &flist)
+	return
+}
+
+func (f *fsck) device(dev string) {
+	// all files on dev, and those that belong to a .zmp file
+	files := make(map[string]os.FileInfo)
+	owned := make(map[string]bool)
+	filepath.Walk(dev, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			files[path] = fi
+		}
+		return nil
+	})
+
+	for path := range files {
+		if !strings.HasSuffix(path, ".zmp") {
+			continue
+		}
+		stem := strings.TrimSuffix(path, ".zmp")
+		owned[path] = true
+		owned[stem+".list"] = true
+		owned[stem+".schema"] = true
+
+		// what is wrong with the outputs, if anything
+		check := func() string {
+			if !fileExists(stem + ".schema") {
+				return "schema file missing"
+			}
+			if !fileExists(stem + ".list") {
+				return ""
+			}
+			flist, err := segments(stem + ".list")
+			if err != nil {
+				return "bad list file -- " + err.Error()
+			}
+			for _, seg := range flist {
+				if !fileExists(seg) {
+					return "segment file " + seg + " missing"
+				}
+			}
+			return ""
+		}
+		if flist, err := segments(stem + ".list"); err == nil {
+			for _, seg := range flist {
+				owned[seg] = true
+			}
+		}
+
+		rel, err := filepath.Rel(dev, stem)
+		if err != nil {
+			continue
+		}
+		nv := strings.SplitN(rel, "/", 2)
+		if len(nv) != 2 {
+			continue
+		}
+		bucket, dir := nv[0], filepath.Dir(nv[1])
+		if dir == "." {
+			dir = ""
+		}
+		keys := keysOfStem(bucket, dir, filepath.Base(stem))
+		if len(keys) == 0 {
+			if !stale(files[path]) {
+				continue
+			}
+			f.report(path, "conversion without cached object", func() error {
+				return lander.RemoveXrgFile(path)
+			})
+			continue
+		}
+		if reason := check(); reason != "" {
+			for _, key := range keys {
+				f.object(bucket, key, reason, func() bool {
+					return check() != ""
+				})
+			}
+		}
+	}
+
+	// .list files of conversions that did not finish with their
+	// segment files, then their .schema files and the files no .zmp
+	// file owns
+	for path, fi := range files {
+		if owned[path] || !stale(fi) || !strings.HasSuffix(path, ".list") {
+			continue
+		}
+		if flist, err := segments(path); err == nil {
+			for _, seg := range flist {
+				if _, ok := files[seg]; ok && !owned[seg] {
+					owned[seg] = true
+					seg := seg
+					f.report(seg, "segment file without zmp file", func() error {
+						return os.Remove(seg)
+					})
+				}
+			}
+		}
+		owned[path] = true
+		path := path
+		f.report(path, "list file without zmp file", func() error {
+			return os.Remove(path)
+		})
+	}
+	for path, fi := range files {
+		if owned[path] || !stale(fi) {
+			continue
+		}
+		reason := "stray file"
+		if strings.HasSuffix(path, ".schema") {
+			reason = "schema file without zmp file"
+		}
+		path := path
+		f.report(path, reason, func() error {
+			return os.Remove(path)
+		})
+	}
+}
+
+// Drop the entries of the index whose meta file is gone
+func (f *fsck) index() {
+	mux.Lock()
+	names := make([][2]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, [2]string{e.Bucket, e.Key})
+	}
+	mux.Unlock()
+
+	for _, nv := range names {
+		bucket, key := nv[0], nv[1]
+		path, err := mapToPath(bucket, key)
+		if err != nil {
+			continue
+		}
+		f.object(bucket, key, "index entry without meta file", func() bool {
+			mux.Lock()
+			indexed := entries[entryName(bucket, key)] != nil
+			mux.Unlock()
+			return indexed && !fileExists(path+"__meta__")
+		})
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"s3pool/lander"
+	"s3pool/strlock"
+	"testing"
+	"time"
+)
+
+// Start an empty index with a lander device in xrg/
+func newFsck(t *testing.T) string {
+	newIndex(t)
+	home, _ := os.Getwd()
+	dev := filepath.Join(home, "xrg")
+	os.Mkdir(dev, 0755)
+	os.Mkdir("tmp", 0755)
+	save := lander.Devices()
+	lander.Init([]string{dev}, 0)
+	t.Cleanup(func() { lander.Init(save, 0) })
+	return dev
+}
+
+// Make path look as if written before s3pool started
+func old(path string) {
+	then := time.Now().Add(-2 * STALE)
+	os.Chtimes(path, then, then)
+}
+
+func touchFile(t *testing.T, path string) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Write the lander outputs of bucket/key on dev with nseg segment
+// files, and return the stem of their paths
+func convert(t *testing.T, dev, bucket, key string, nseg int) string {
+	stem := filepath.Join(dev, bucket, filepath.Dir(key), lander.Stem(filepath.Base(key)))
+	var flist []string
+	for i := 0; i < nseg; i++ {
+		seg := stem + "." + string(rune('0'+i)) + ".xrg"
+		touchFile(t, seg)
+		flist = append(flist, seg)
+	}
+	byt, _ := json.Marshal(flist)
+	touchFile(t, stem+".zmp")
+	touchFile(t, stem+".schema")
+	if err := ioutil.WriteFile(stem+".list", byt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return stem
+}
+
+// Return the reasons of the problems by path
+func reasons(problems []Problem, action string, t *testing.T) map[string]string {
+	r := make(map[string]string)
+	for _, p := range problems {
+		if p.Action != action {
+			t.Errorf("%s %s -- %s, want %s", p.Action, p.Path, p.Reason, action)
+		}
+		r[p.Path] = p.Reason
+	}
+	return r
+}
+
+func TestFsckWholeObjects(t *testing.T) {
+	dev := newFsck(t)
+	putObject(t, "b", "plain", 100, time.Hour)
+	putObject(t, "b", "dir/conv.csv", 100, time.Hour)
+	convert(t, dev, "b", "dir/conv.csv", 3)
+	touchFile(t, "data/b/dir/conv.csv__meta__")
+
+	if problems := Fsck(true); len(problems) != 0 {
+		t.Errorf("Fsck found %v in a sound cache", problems)
+	}
+	if !cached("b", "plain") || !cached("b", "dir/conv.csv") {
+		t.Error("Fsck removed sound objects")
+	}
+}
+
+func TestFsckTmp(t *testing.T) {
+	newFsck(t)
+	for _, name := range []string{"dfs_old", "s3f_old", "dfs_new", "other"} {
+		touchFile(t, filepath.Join("tmp", name))
+	}
+	old("tmp/dfs_old")
+	old("tmp/s3f_old")
+	old("tmp/other")
+
+	r := reasons(Fsck(false), "found", t)
+	if len(r) != 2 || r["tmp/dfs_old"] == "" || r["tmp/s3f_old"] == "" {
+		t.Errorf("Fsck found %v, want the stale temp files", r)
+	}
+	if !fileExists("tmp/dfs_old") {
+		t.Error("Fsck removed a file without repair")
+	}
+
+	reasons(Fsck(true), "removed", t)
+	if fileExists("tmp/dfs_old") || fileExists("tmp/s3f_old") {
+		t.Error("Fsck did not remove stale temp files")
+	}
+	if !fileExists("tmp/dfs_new") || !fileExists("tmp/other") {
+		t.Error("Fsck removed a fresh temp file or a file of another kind")
+	}
+}
+
+func TestFsckData(t *testing.T) {
+	newFsck(t)
+	putObject(t, "b", "ok", 100, time.Hour)
+	touchFile(t, "data/b/nometa")
+	touchFile(t, "data/b/nosrc__meta__")
+	putObject(t, "b", "gone", 100, time.Hour)
+	os.Remove("data/b/gone__meta__")
+	os.Remove("data/b/gone")
+
+	want := map[string]string{
+		"b:nometa": "source file without meta file",
+		"b:nosrc":  "meta file without source file",
+		"b:gone":   "index entry without meta file",
+	}
+	r := reasons(Fsck(false), "found", t)
+	for name, reason := range want {
+		if r[name] != reason {
+			t.Errorf("Fsck reported %s as %q, want %q", name, r[name], reason)
+		}
+	}
+	if len(r) != len(want) || !fileExists("data/b/nometa") || Count() != 2 {
+		t.Errorf("Fsck without repair found %v and changed the cache", r)
+	}
+
+	reasons(Fsck(true), "removed", t)
+	if fileExists("data/b/nometa") || fileExists("data/b/nosrc__meta__") || Count() != 1 {
+		t.Error("Fsck did not remove the broken objects")
+	}
+	if !cached("b", "ok") {
+		t.Error("Fsck removed a sound object")
+	}
+	if problems := Fsck(true); len(problems) != 0 {
+		t.Errorf("Fsck found %v after repair", problems)
+	}
+}
+
+// In local mode the source file lives outside data/
+func TestFsckLocal(t *testing.T) {
+	newFsck(t)
+	save := conf.DfsMode
+	conf.DfsMode = conf.DFS_LOCAL
+	defer func() { conf.DfsMode = save }()
+
+	touchFile(t, "data/b/k__meta__")
+	if problems := Fsck(true); len(problems) != 0 {
+		t.Errorf("Fsck found %v in local mode", problems)
+	}
+	if !fileExists("data/b/k__meta__") {
+		t.Error("Fsck removed the meta file of a local object")
+	}
+}
+
+func TestFsckSegments(t *testing.T) {
+	dev := newFsck(t)
+	putObject(t, "b", "seg.csv", 100, time.Hour)
+	stem := convert(t, dev, "b", "seg.csv", 3)
+	os.Remove(stem + ".1.xrg")
+	putObject(t, "b", "noschema.csv", 100, time.Hour)
+	os.Remove(convert(t, dev, "b", "noschema.csv", 1) + ".schema")
+	putObject(t, "b", "badlist.csv", 100, time.Hour)
+	ioutil.WriteFile(convert(t, dev, "b", "badlist.csv", 1)+".list", []byte("["), 0644)
+
+	r := reasons(Fsck(false), "found", t)
+	if r["b:seg.csv"] != "segment file "+stem+".1.xrg missing" {
+		t.Errorf("Fsck reported b:seg.csv as %q", r["b:seg.csv"])
+	}
+	if r["b:noschema.csv"] != "schema file missing" {
+		t.Errorf("Fsck reported b:noschema.csv as %q", r["b:noschema.csv"])
+	}
+	if len(r["b:badlist.csv"]) < len("bad list file") || r["b:badlist.csv"][:13] != "bad list file" {
+		t.Errorf("Fsck reported b:badlist.csv as %q", r["b:badlist.csv"])
+	}
+
+	// the object goes as a whole, source and outputs alike
+	reasons(Fsck(true), "removed", t)
+	for _, path := range []string{stem + ".zmp", stem + ".list", stem + ".0.xrg", stem + ".2.xrg", "data/b/seg.csv"} {
+		if fileExists(path) {
+			t.Errorf("Fsck left %s of a broken object", path)
+		}
+	}
+	if Count() != 0 {
+		t.Errorf("Fsck left %d objects in the index", Count())
+	}
+}
+
+func TestFsckStray(t *testing.T) {
+	dev := newFsck(t)
+
+	// a conversion whose object is gone
+	orphan := convert(t, dev, "b", "orphan.csv", 1)
+	old(orphan + ".zmp")
+	fresh := convert(t, dev, "b", "fresh.csv", 1)
+
+	// a conversion that did not finish, and a stray file
+	unfinished := convert(t, dev, "b", "unfinished.csv", 2)
+	os.Remove(unfinished + ".zmp")
+	stray := filepath.Join(dev, "b", "stray")
+	touchFile(t, stray)
+	for _, path := range []string{unfinished + ".list", unfinished + ".schema", unfinished + ".0.xrg", unfinished + ".1.xrg", stray} {
+		old(path)
+	}
+
+	want := map[string]string{
+		orphan + ".zmp":        "conversion without cached object",
+		unfinished + ".list":   "list file without zmp file",
+		unfinished + ".schema": "schema file without zmp file",
+		unfinished + ".0.xrg":  "segment file without zmp file",
+		unfinished + ".1.xrg":  "segment file without zmp file",
+		stray:                  "stray file",
+	}
+	r := reasons(Fsck(true), "removed", t)
+	for path, reason := range want {
+		if r[path] != reason {
+			t.Errorf("Fsck reported %s as %q, want %q", path, r[path], reason)
+		}
+		if fileExists(path) {
+			t.Errorf("Fsck did not remove %s", path)
+		}
+	}
+	if len(r) != len(want) {
+		t.Errorf("Fsck reported %v", r)
+	}
+	if fileExists(orphan + ".0.xrg") {
+		t.Error("Fsck left a segment of a conversion without cached object")
+	}
+	if !fileExists(fresh + ".zmp") {
+		t.Error("Fsck removed a conversion that may be in progress")
+	}
+}
+
+func TestFsckSkipsBusy(t *testing.T) {
+	newFsck(t)
+	touchFile(t, "data/b/nometa")
+	lockname, _ := strlock.Lock("b:nometa")
+
+	if problems := Fsck(true); len(problems) != 0 {
+		t.Errorf("Fsck found %v in an object being pulled", problems)
+	}
+	strlock.Unlock(lockname)
+	if problems := Fsck(true); len(problems) != 1 || fileExists("data/b/nometa") {
+		t.Errorf("Fsck found %v once the pull was done", problems)
+	}
+}
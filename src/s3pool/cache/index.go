@@ -0,0 +1,523 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"s3pool/lander"
+	"s3pool/strlock"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The index keeps one entry per cached object with its size on each
+// device, its last access time and its number of hits. The usage of
+// each device is the sum of the entries' sizes, so no scan of the
+// disk is needed.
+//
+// Entries are grouped by bucket. Each bucket keeps two heaps ordered
+// by the eviction policy: RECENT holds objects that were pulled once
+// and FREQUENT holds those pulled more than once. The victim of a
+// bucket is found in O(log n), and the global victim is the best of
+// the bucket victims.
+//
+// The index is checkpointed to CHECKPOINT from time to time. On
+// startup it is loaded from there and then reconciled against the
+// meta files in data/ in the background.
+
+const CHECKPOINT = "cache.idx"
+
+const (
+	RECENT   = 0
+	FREQUENT = 1
+)
+
+type Entry struct {
+	Bucket string
+	Key    string
+	Bytes  []int64 // bytes used on each device; see Devices()
+	Atime  time.Time
+	Hits   int64
+	seg    int  // RECENT or FREQUENT
+	index  int  // position in the heap; -1 if not in heap
+	pinned bool // pinned entries are not in any heap
+}
+
+func (e *Entry) total() (n int64) {
+	for _, b := range e.Bytes {
+		n += b
+	}
+	return
+}
+
+type entryHeap []*Entry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return policy.less(h[i], h[j]) }
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*Entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+type bucketIndex struct {
+	seg   [2]entryHeap
+	count int   // # entries, in heap or not
+	bytes int64 // bytes of all entries on all devices
+}
+
+var mux sync.Mutex
+var devices []string // abs path of data/ followed by the lander devices
+var usage []int64    // bytes used on each device
+var segBytes [2]int64
+var entries = map[string]*Entry{}
+var buckets = map[string]*bucketIndex{}
+var quotas = map[string]int64{}
+var held = map[string]int{} // objects that must not be evicted
+var ready bool              // true after the index has been reconciled with data/
+
+func entryName(bucket, key string) string {
+	return bucket + ":" + key
+}
+
+// Load the index from the checkpoint file and reconcile it with the
+// content of data/ in the background. Must be called after lander.Init.
+func Init() {
+	devices = nil
+	for _, dir := range append([]string{"data"}, lander.Devices()...) {
+		path, err := filepath.Abs(dir)
+		if err != nil {
+			log.Println("cache:", err)
+			path = dir
+		}
+		devices = append(devices, path)
+	}
+	usage = make([]int64, len(devices))
+
+	if err := loadPins(); err != nil && !os.IsNotExist(err) {
+		log.Println("cache: cannot load pins --", err)
+	}
+	if err := load(); err != nil && !os.IsNotExist(err) {
+		log.Println("cache: cannot load checkpoint --", err)
+	}
+
+	go func() {
+		// repair what a crash left behind before taking stock
+		for _, p := range Fsck(true) {
+			log.Printf("cache: fsck %s %s -- %s\n", p.Action, p.Path, p.Reason)
+		}
+
+		startTime := time.Now()
+		n, err := reconcile()
+		if err != nil {
+			log.Println("cache: reconcile failed --", err)
+		}
+		mux.Lock()
+		ready = true
+		mux.Unlock()
+		log.Printf("cache: index ready, %d objects, %d added during reconcile, %d ms\n",
+			Count(), n, int(time.Since(startTime)/time.Millisecond))
+	}()
+}
+
+// Return the device directories tracked by the index
+func Devices() []string {
+	return devices
+}
+
+// Return the bytes used by cached objects on device i
+func Usage(i int) int64 {
+	mux.Lock()
+	defer mux.Unlock()
+	return usage[i]
+}
+
+// Return the bytes used by cached objects of bucket on all devices
+func BucketUsage(bucket string) int64 {
+	mux.Lock()
+	defer mux.Unlock()
+	if b := buckets[bucket]; b != nil {
+		return b.bytes
+	}
+	return 0
+}
+
+// Return the number of cached objects
+func Count() int {
+	mux.Lock()
+	defer mux.Unlock()
+	return len(entries)
+}
+
+// Is the index complete?
+func Ready() bool {
+	mux.Lock()
+	defer mux.Unlock()
+	return ready
+}
+
+// Limit the bytes cached for bucket. A quota of 0 means no limit.
+func SetQuota(bucket string, nbytes int64) {
+	mux.Lock()
+	if nbytes <= 0 {
+		delete(quotas, bucket)
+	} else {
+		quotas[bucket] = nbytes
+	}
+	mux.Unlock()
+}
+
+// Return a copy of the bucket quotas
+func Quotas() map[string]int64 {
+	mux.Lock()
+	defer mux.Unlock()
+	ret := make(map[string]int64, len(quotas))
+	for k, v := range quotas {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Which device does path reside on?
+func deviceOf(path string) int {
+	ret, retlen := -1, 0
+	for i, dev := range devices {
+		if strings.HasPrefix(path, dev+"/") && len(dev) > retlen {
+			ret, retlen = i, len(dev)
+		}
+	}
+	return ret
+}
+
+// Return bytes allocated to each device by the files of (bucket, key)
+func measure(bucket, key string) []int64 {
+	bytes := make([]int64, len(devices))
+	for _, f := range Files(bucket, key) {
+		st, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if i := deviceOf(f); i >= 0 {
+			bytes[i] += st.Sys().(*syscall.Stat_t).Blocks * 512
+		}
+	}
+	return bytes
+}
+
+// Put e back into the heap of its segment unless it is pinned.
+// Caller must hold mux.
+func push(e *Entry) {
+	if e.pinned {
+		return
+	}
+	b := buckets[e.Bucket]
+	if b == nil {
+		b = &bucketIndex{}
+		buckets[e.Bucket] = b
+	}
+	heap.Push(&b.seg[e.seg], e)
+}
+
+// Take e out of its heap. Caller must hold mux.
+func unpush(e *Entry) {
+	if e.index >= 0 {
+		heap.Remove(&buckets[e.Bucket].seg[e.seg], e.index)
+	}
+}
+
+// caller must hold mux
+func insert(e *Entry) {
+	if old := entries[entryName(e.Bucket, e.Key)]; old != nil {
+		drop(old)
+	}
+	if e.Hits > 1 {
+		e.seg = FREQUENT
+	} else {
+		e.seg = RECENT
+	}
+
+	e.index = -1
+	applyPins(e)
+	if e.pinned {
+		pinnedBytes += e.total()
+	}
+
+	entries[entryName(e.Bucket, e.Key)] = e
+	for i := range e.Bytes {
+		usage[i] += e.Bytes[i]
+	}
+	push(e)
+	if buckets[e.Bucket] == nil {
+		buckets[e.Bucket] = &bucketIndex{}
+	}
+	buckets[e.Bucket].count++
+	buckets[e.Bucket].bytes += e.total()
+	segBytes[e.seg] += e.total()
+}
+
+// caller must hold mux
+func drop(e *Entry) {
+	if entries[entryName(e.Bucket, e.Key)] != e {
+		return
+	}
+	unpush(e)
+	delete(entries, entryName(e.Bucket, e.Key))
+	for i := range e.Bytes {
+		usage[i] -= e.Bytes[i]
+	}
+	if e.pinned {
+		pinnedBytes -= e.total()
+	}
+	b := buckets[e.Bucket]
+	b.count--
+	b.bytes -= e.total()
+	segBytes[e.seg] -= e.total()
+	if b.count == 0 {
+		delete(buckets, e.Bucket)
+	}
+}
+
+// Record (bucket, key) as freshly downloaded or converted. Its files
+// are measured again.
+func Add(bucket, key string) {
+	bytes := measure(bucket, key)
+	mux.Lock()
+	var hits int64
+	if old := entries[entryName(bucket, key)]; old != nil {
+		hits = old.Hits
+	}
+	e := &Entry{Bucket: bucket, Key: key, Bytes: bytes, Atime: time.Now(), Hits: hits + 1}
+	policy.admit(e)
+	insert(e)
+	mux.Unlock()
+}
+
+// Record an access to (bucket, key) that was served from the cache
+func Touch(bucket, key string) {
+	mux.Lock()
+	e := entries[entryName(bucket, key)]
+	if e != nil {
+		inheap := e.index >= 0
+		unpush(e)
+		e.Atime = time.Now()
+		e.Hits++
+		if e.seg == RECENT && e.Hits > 1 {
+			segBytes[RECENT] -= e.total()
+			segBytes[FREQUENT] += e.total()
+			e.seg = FREQUENT
+		}
+		if inheap {
+			push(e)
+		}
+	}
+	mux.Unlock()
+
+	if e == nil {
+		Add(bucket, key)
+	}
+}
+
+// Return the keys of bucket in the index that pass filter
+func Keys(bucket string, filter func(string) bool) (keys []string) {
+	mux.Lock()
+	for _, e := range entries {
+		if e.Bucket == bucket && filter(e.Key) {
+			keys = append(keys, e.Key)
+		}
+	}
+	mux.Unlock()
+	sort.Strings(keys)
+	return
+}
+
+// Forget about (bucket, key) without touching its files
+func Forget(bucket, key string) {
+	mux.Lock()
+	if e := entries[entryName(bucket, key)]; e != nil {
+		drop(e)
+	}
+	mux.Unlock()
+}
+
+// Keep (bucket, key) from eviction until as many calls to Release
+func Hold(bucket, key string) {
+	mux.Lock()
+	held[entryName(bucket, key)]++
+	mux.Unlock()
+}
+
+func Release(bucket, key string) {
+	name := entryName(bucket, key)
+	mux.Lock()
+	if held[name]--; held[name] <= 0 {
+		delete(held, name)
+	}
+	mux.Unlock()
+}
+
+// Return the victim of bucket b according to the policy, or nil.
+// Caller must hold mux.
+func (b *bucketIndex) victim() *Entry {
+	r, f := b.seg[RECENT], b.seg[FREQUENT]
+	switch {
+	case len(r) == 0 && len(f) == 0:
+		return nil
+	case len(r) == 0:
+		return f[0]
+	case len(f) == 0:
+		return r[0]
+	case policy.segmented:
+		return b.seg[policy.segment()][0]
+	case policy.less(r[0], f[0]):
+		return r[0]
+	}
+	return f[0]
+}
+
+// Return the victim among all buckets, or among the buckets over
+// quota if overQuota is set. Caller must hold mux.
+func victim(overQuota bool) *Entry {
+	var ret *Entry
+	for name, b := range buckets {
+		if overQuota && (quotas[name] == 0 || b.bytes <= quotas[name]) {
+			continue
+		}
+		e := b.victim()
+		if e == nil {
+			continue
+		}
+		if ret == nil {
+			ret = e
+		} else if policy.segmented && e.seg != ret.seg {
+			// prefer the segment the policy wants to shrink
+			if e.seg == policy.segment() {
+				ret = e
+			}
+		} else if policy.less(e, ret) {
+			ret = e
+		}
+	}
+	return ret
+}
+
+// Delete the files of e. Returns false if e was pulled or pinned after
+// it was chosen as victim, or if its files cannot be removed.
+func evictOne(e *Entry) bool {
+	mux.Lock()
+	atime := e.Atime
+	mux.Unlock()
+
+	// skip objects being pulled; they are not good victims anyway
+	ctx := strlock.WithOwner(context.Background(), "evict")
+	lockname, err := strlock.TryLock(ctx, e.Bucket+":"+e.Key)
+	if err != nil {
+		return false
+	}
+	defer strlock.Unlock(lockname)
+
+	// it may have been pulled, pinned or held since it was chosen
+	mux.Lock()
+	name := entryName(e.Bucket, e.Key)
+	touched := !e.Atime.Equal(atime) || entries[name] != e || e.pinned || held[name] > 0
+	mux.Unlock()
+	if touched {
+		return false
+	}
+	if err = Remove(e.Bucket, e.Key); err != nil {
+		log.Printf("cache: cannot remove %s:%s -- %v\n", e.Bucket, e.Key, err)
+		return false
+	}
+	mux.Lock()
+	policy.evicted(e)
+	mux.Unlock()
+	return true
+}
+
+// Evict objects that have files on device dev until at least nbytes
+// are freed on it, or evict from buckets over their quota until they
+// are within quota if dev < 0. Returns the number of objects evicted
+// and the bytes freed.
+func evict(dev int, nbytes int64) (count int, freed int64) {
+	var aside []*Entry
+	defer func() {
+		// put back entries that were skipped
+		mux.Lock()
+		for _, e := range aside {
+			if entries[entryName(e.Bucket, e.Key)] == e && e.index < 0 {
+				push(e)
+			}
+		}
+		mux.Unlock()
+	}()
+
+	for dev < 0 || freed < nbytes {
+		mux.Lock()
+		e := victim(dev < 0)
+		if e == nil {
+			mux.Unlock()
+			return
+		}
+		unpush(e)
+		mux.Unlock()
+
+		if dev >= 0 && e.Bytes[dev] == 0 {
+			aside = append(aside, e)
+			continue
+		}
+		if !evictOne(e) {
+			aside = append(aside, e)
+			continue
+		}
+		count++
+		if dev >= 0 {
+			freed += e.Bytes[dev]
+		} else {
+			freed += e.total()
+		}
+	}
+	return
+}
+
+// Evict objects that have files on device dev until at least nbytes
+// are freed on it. Returns the number of objects evicted and the
+// bytes freed on dev.
+func Evict(dev int, nbytes int64) (count int, freed int64) {
+	return evict(dev, nbytes)
+}
+
+// Evict objects of buckets over their quota until they are within
+// quota. Returns the number of objects evicted and the bytes freed.
+func EnforceQuotas() (count int, freed int64) {
+	return evict(-1, 0)
+}
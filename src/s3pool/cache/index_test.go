@@ -0,0 +1,260 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/strlock"
+	"testing"
+	"time"
+)
+
+// Start an empty index over data/ in a fresh home directory
+func newIndex(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	if err = os.Chdir(home); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.Mkdir("data", 0755)
+
+	reset(t, "lru")
+	mux.Lock()
+	devices = []string{filepath.Join(home, "data")}
+	quotas = map[string]int64{}
+	held = map[string]int{}
+	mux.Unlock()
+}
+
+// Write an object of nbytes to data/ as a PULL would, and index it as
+// last used age ago
+func putObject(t *testing.T, bucket, key string, nbytes int, age time.Duration) {
+	path := filepath.Join("data", bucket, key)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, make([]byte, nbytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path+"__meta__", []byte("{}"), 0644)
+	Add(bucket, key)
+
+	mux.Lock()
+	e := entries[entryName(bucket, key)]
+	unpush(e)
+	e.Atime = time.Now().Add(-age)
+	push(e)
+	mux.Unlock()
+}
+
+func cached(bucket, key string) bool {
+	_, err := os.Stat(filepath.Join("data", bucket, key+"__meta__"))
+	return err == nil && entries[entryName(bucket, key)] != nil
+}
+
+func TestIndexUsage(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "k1", 10000, time.Hour)
+	putObject(t, "b", "dir/k2", 20000, time.Hour)
+	putObject(t, "c", "k3", 5000, time.Hour)
+
+	if n := Count(); n != 3 {
+		t.Errorf("Count() = %d, want 3", n)
+	}
+	// usage is what the files take on disk, meta files included
+	if u := Usage(0); u < 35000 {
+		t.Errorf("Usage(0) = %d, want at least 35000", u)
+	}
+	if ub, uc := BucketUsage("b"), BucketUsage("c"); ub+uc != Usage(0) || ub < 30000 {
+		t.Errorf("bucket usage %d + %d does not add up to %d", ub, uc, Usage(0))
+	}
+
+	// adding an object again measures it again
+	ioutil.WriteFile("data/c/k3", nil, 0644)
+	Add("c", "k3")
+	if uc := BucketUsage("c"); uc >= 5000 {
+		t.Errorf("BucketUsage(c) = %d after truncation", uc)
+	}
+
+	Forget("b", "k1")
+	Forget("b", "dir/k2")
+	Forget("nosuch", "k")
+	if ub := BucketUsage("b"); ub != 0 {
+		t.Errorf("BucketUsage(b) = %d after Forget", ub)
+	}
+	if Count() != 1 || Usage(0) != BucketUsage("c") {
+		t.Errorf("Count() = %d, Usage(0) = %d after Forget", Count(), Usage(0))
+	}
+}
+
+func TestTouch(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "k", 100, time.Hour)
+	before := entries[entryName("b", "k")].Atime
+	Touch("b", "k")
+	e := entries[entryName("b", "k")]
+	if !e.Atime.After(before) || e.Hits != 2 {
+		t.Errorf("Touch left atime %v and hits %d", e.Atime, e.Hits)
+	}
+
+	// an object touched but not in the index is measured and added
+	os.MkdirAll("data/b", 0755)
+	ioutil.WriteFile("data/b/new", make([]byte, 100), 0644)
+	ioutil.WriteFile("data/b/new__meta__", []byte("{}"), 0644)
+	Touch("b", "new")
+	if !cached("b", "new") {
+		t.Error("Touch did not add a new object")
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "old", 10000, 3*time.Hour)
+	putObject(t, "b", "mid", 10000, 2*time.Hour)
+	putObject(t, "b", "new", 10000, time.Hour)
+
+	count, freed := Evict(0, 1)
+	if count != 1 || freed < 10000 {
+		t.Errorf("Evict(0, 1) = %d, %d; want 1 object of at least 10000 bytes", count, freed)
+	}
+	if cached("b", "old") || !cached("b", "mid") || !cached("b", "new") {
+		t.Error("Evict did not take the least recently used object")
+	}
+	if _, err := os.Stat("data/b/old"); !os.IsNotExist(err) {
+		t.Error("the data file of the victim is still there")
+	}
+}
+
+func TestEvictSkipsBusy(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "held", 10000, 4*time.Hour)
+	putObject(t, "b", "locked", 10000, 3*time.Hour)
+	putObject(t, "b", "free", 10000, 2*time.Hour)
+
+	Hold("b", "held")
+	defer Release("b", "held")
+	lockname, _ := strlock.Lock("b:locked")
+	defer strlock.Unlock(lockname)
+
+	if count, _ := Evict(0, 1); count != 1 {
+		t.Fatalf("Evict evicted %d objects, want 1", count)
+	}
+	if !cached("b", "held") || !cached("b", "locked") || cached("b", "free") {
+		t.Error("Evict took an object held or locked")
+	}
+
+	// the objects skipped go back into the heap
+	if e := victim(false); e == nil || e.Key != "held" {
+		t.Errorf("next victim is %v, want held", e)
+	}
+	if count, _ := Evict(0, 1<<30); count != 0 {
+		t.Errorf("Evict of busy objects evicted %d", count)
+	}
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	newIndex(t)
+	putObject(t, "big", "k1", 10000, 3*time.Hour)
+	putObject(t, "big", "k2", 10000, time.Hour)
+	putObject(t, "small", "k", 10000, 5*time.Hour)
+	SetQuota("big", BucketUsage("big")-1)
+
+	if count, _ := EnforceQuotas(); count != 1 {
+		t.Errorf("EnforceQuotas evicted %d objects, want 1", count)
+	}
+	if cached("big", "k1") || !cached("big", "k2") || !cached("small", "k") {
+		t.Error("EnforceQuotas evicted from the wrong bucket")
+	}
+	SetQuota("big", 0)
+	if _, ok := Quotas()["big"]; ok {
+		t.Error("quota 0 did not remove the quota")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "k1", 10000, time.Hour)
+	putObject(t, "b", "k2", 20000, 2*time.Hour)
+	Touch("b", "k2")
+	want := map[string]*Entry{}
+	for name, e := range entries {
+		w := *e
+		want[name] = &w
+	}
+	if err := Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	reset(t, "lru")
+	if err := load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries loaded, want %d", len(entries), len(want))
+	}
+	for name, w := range want {
+		e := entries[name]
+		if e == nil || !e.Atime.Equal(w.Atime) || e.Hits != w.Hits || e.total() != w.total() {
+			t.Errorf("%s loaded as %+v, want %+v", name, e, w)
+		}
+	}
+	if u := Usage(0); u != want["b:k1"].total()+want["b:k2"].total() {
+		t.Errorf("Usage(0) = %d after load", u)
+	}
+}
+
+func TestCheckpointNewDevices(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "k", 10000, time.Hour)
+	if err := Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a device was added since; the sizes are measured again
+	reset(t, "lru")
+	devices = append(devices, "/nosuch")
+	usage = make([]int64, 2)
+	if err := load(); err != nil {
+		t.Fatal(err)
+	}
+	e := entries["b:k"]
+	if e == nil || len(e.Bytes) != 2 || e.Bytes[0] < 10000 || e.Bytes[1] != 0 {
+		t.Errorf("entry loaded as %+v", e)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "kept", 100, time.Hour)
+	putObject(t, "b", "gone", 100, time.Hour)
+	os.Remove("data/b/gone__meta__")
+
+	// pulled while the daemon was down
+	ioutil.WriteFile("data/b/found", make([]byte, 100), 0644)
+	ioutil.WriteFile("data/b/found__meta__", []byte("{}"), 0644)
+
+	added, err := reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || !cached("b", "found") || !cached("b", "kept") {
+		t.Errorf("reconcile added %d objects", added)
+	}
+	if entries["b:gone"] != nil {
+		t.Error("reconcile kept an object without its meta file")
+	}
+}
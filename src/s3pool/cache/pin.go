@@ -0,0 +1,246 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cktan/glob"
+	"io/ioutil"
+	"log"
+	"os"
+	"s3pool/conf"
+)
+
+// A pin is a glob pattern on the keys of a bucket. Cached objects that
+// match a pin are kept out of the eviction heaps; they stay cached
+// until they are unpinned or explicitly removed. The pins are saved in
+// PINFILE so that they survive a restart. The bytes of pinned objects
+// are capped by conf.PinLimit. A pin is made by PIN, by the pin setting
+// of SETB, or by both, and lasts until each that made it drops it.
+
+const PINFILE = "pins.json"
+
+type Pin struct {
+	Bucket  string
+	Pattern string
+	User    bool // made by PIN
+	Setb    bool // made by the pin setting of the bucket
+	g       glob.Glob
+}
+
+// Return the flag of p for the maker of a pin
+func (p *Pin) by(setb bool) *bool {
+	if setb {
+		return &p.Setb
+	}
+	return &p.User
+}
+
+var pins []*Pin
+var pinnedBytes int64
+
+func (p *Pin) match(e *Entry) bool {
+	return p.Bucket == e.Bucket && p.g.Match(e.Key)
+}
+
+// Should e be pinned? Caller must hold mux.
+func pinMatch(e *Entry) bool {
+	for _, p := range pins {
+		if p.match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark e as pinned if a pin matches it and the limit allows. Caller
+// must hold mux, and e must not be in a heap.
+func applyPins(e *Entry) {
+	e.pinned = false
+	if !pinMatch(e) {
+		return
+	}
+	if conf.PinLimit > 0 && pinnedBytes+e.total() > conf.PinLimit {
+		log.Printf("cache: pin limit reached; %s:%s is not pinned\n", e.Bucket, e.Key)
+		return
+	}
+	e.pinned = true
+}
+
+func savePins() error {
+	byt, err := json.Marshal(pins)
+	if err != nil {
+		return err
+	}
+	tmppath := PINFILE + ".tmp"
+	if err = ioutil.WriteFile(tmppath, byt, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, PINFILE)
+}
+
+func loadPins() error {
+	byt, err := ioutil.ReadFile(PINFILE)
+	if err != nil {
+		return err
+	}
+	var saved []*Pin
+	if err = json.Unmarshal(byt, &saved); err != nil {
+		return err
+	}
+	for _, p := range saved {
+		if !p.User && !p.Setb {
+			// saved before pins had makers
+			p.User = true
+		}
+		if p.g, err = glob.Compile(p.Pattern, '/'); err != nil {
+			log.Printf("cache: bad pin %s %s -- %v\n", p.Bucket, p.Pattern, err)
+			continue
+		}
+		pins = append(pins, p)
+	}
+	return nil
+}
+
+// Pin the cached objects of bucket that match pattern, and those that
+// will be cached later, on behalf of SETB if setb or else of PIN.
+// Returns the number of objects and bytes newly pinned. Fails if that
+// would take the pinned bytes over the limit.
+func PinObjects(bucket, pattern string, setb bool) (count int, nbytes int64, err error) {
+	g, err := glob.Compile(pattern, '/')
+	if err != nil {
+		return
+	}
+	p := &Pin{Bucket: bucket, Pattern: pattern, g: g}
+	*p.by(setb) = true
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	for _, x := range pins {
+		if x.Bucket == bucket && x.Pattern == pattern {
+			if *x.by(setb) {
+				return 0, 0, fmt.Errorf("%s %s is already pinned", bucket, pattern)
+			}
+			// pinned by the other maker already
+			*x.by(setb) = true
+			if err = savePins(); err != nil {
+				*x.by(setb) = false
+				return 0, 0, err
+			}
+			return 0, 0, nil
+		}
+	}
+
+	var matched []*Entry
+	for _, e := range entries {
+		if !e.pinned && p.match(e) {
+			matched = append(matched, e)
+			nbytes += e.total()
+		}
+	}
+	if conf.PinLimit > 0 && pinnedBytes+nbytes > conf.PinLimit {
+		return 0, 0, fmt.Errorf("Pin limit exceeded -- %d bytes pinned, %d more requested, limit %d",
+			pinnedBytes, nbytes, conf.PinLimit)
+	}
+
+	pins = append(pins, p)
+	if err = savePins(); err != nil {
+		pins = pins[:len(pins)-1]
+		return 0, 0, err
+	}
+
+	for _, e := range matched {
+		unpush(e)
+		e.pinned = true
+		pinnedBytes += e.total()
+	}
+	return len(matched), nbytes, nil
+}
+
+// Remove the pin (bucket, pattern) made on behalf of SETB if setb or
+// else of PIN. The pin stays if the other made it too. Objects that no
+// longer match any pin become evictable again. Returns the number of
+// objects and bytes unpinned.
+func UnpinObjects(bucket, pattern string, setb bool) (count int, nbytes int64, err error) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	idx := -1
+	for i, x := range pins {
+		if x.Bucket == bucket && x.Pattern == pattern && *x.by(setb) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return 0, 0, fmt.Errorf("%s %s is not pinned", bucket, pattern)
+	}
+	if x := pins[idx]; *x.by(!setb) {
+		*x.by(setb) = false
+		if err = savePins(); err != nil {
+			*x.by(setb) = true
+		}
+		return 0, 0, err
+	}
+
+	saved := pins
+	pins = append(append([]*Pin(nil), pins[:idx]...), pins[idx+1:]...)
+	if err = savePins(); err != nil {
+		pins = saved
+		return 0, 0, err
+	}
+
+	for _, e := range entries {
+		if e.pinned && e.Bucket == bucket && !pinMatch(e) {
+			e.pinned = false
+			pinnedBytes -= e.total()
+			push(e)
+			count++
+			nbytes += e.total()
+		}
+	}
+	return
+}
+
+// Is (bucket, pattern) a pin made on behalf of SETB if setb or else of
+// PIN?
+func HasPin(bucket, pattern string, setb bool) bool {
+	mux.Lock()
+	defer mux.Unlock()
+	for _, p := range pins {
+		if p.Bucket == bucket && p.Pattern == pattern {
+			return *p.by(setb)
+		}
+	}
+	return false
+}
+
+// Return a copy of the pins
+func Pins() []Pin {
+	mux.Lock()
+	defer mux.Unlock()
+	ret := make([]Pin, len(pins))
+	for i, p := range pins {
+		ret[i] = *p
+	}
+	return ret
+}
+
+// Return the bytes of pinned objects
+func PinnedBytes() int64 {
+	mux.Lock()
+	defer mux.Unlock()
+	return pinnedBytes
+}
@@ -0,0 +1,152 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"io/ioutil"
+	"s3pool/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pinned(bucket, key string) bool {
+	mux.Lock()
+	defer mux.Unlock()
+	e := entries[entryName(bucket, key)]
+	return e != nil && e.pinned && e.index < 0
+}
+
+func TestPinKeepsObjects(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "dim/a", 10000, 3*time.Hour)
+	putObject(t, "b", "fact/x", 10000, time.Hour)
+
+	count, nbytes, err := PinObjects("b", "dim/*", false)
+	if err != nil || count != 1 || nbytes != BucketUsage("b")/2 {
+		t.Fatalf("PinObjects = %d, %d, %v", count, nbytes, err)
+	}
+	if PinnedBytes() != nbytes || !pinned("b", "dim/a") {
+		t.Errorf("dim/a not pinned; %d bytes pinned", PinnedBytes())
+	}
+
+	// the pin holds for objects pulled later too
+	putObject(t, "b", "dim/b", 10000, 4*time.Hour)
+	if !pinned("b", "dim/b") {
+		t.Error("dim/b pulled after the pin is not pinned")
+	}
+
+	if count, _ := Evict(0, 1<<30); count != 1 || !cached("b", "dim/a") || !cached("b", "dim/b") {
+		t.Errorf("Evict evicted %d objects, pinned ones included", count)
+	}
+}
+
+func TestPinErrors(t *testing.T) {
+	newIndex(t)
+	if _, _, err := PinObjects("b", "a*", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PinObjects("b", "a*", false); err == nil {
+		t.Error("second PIN of the same pattern did not fail")
+	}
+	if _, _, err := UnpinObjects("b", "b*", false); err == nil {
+		t.Error("UNPIN of a pattern not pinned did not fail")
+	}
+	if _, _, err := UnpinObjects("b", "a*", true); err == nil {
+		t.Error("SETB unpinned a pin made by PIN")
+	}
+	if _, _, err := PinObjects("b", "[", false); err == nil {
+		t.Error("PIN of a bad pattern did not fail")
+	}
+}
+
+func TestPinLimit(t *testing.T) {
+	newIndex(t)
+	save := conf.PinLimit
+	defer func() { conf.PinLimit = save }()
+
+	putObject(t, "b", "k1", 10000, time.Hour)
+	putObject(t, "b", "k2", 10000, time.Hour)
+	one := BucketUsage("b") / 2
+	conf.PinLimit = one + one/2
+
+	_, _, err := PinObjects("b", "k*", false)
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("PinObjects over the limit = %v", err)
+	}
+	if len(Pins()) != 0 || PinnedBytes() != 0 || pinned("b", "k1") {
+		t.Error("a PIN over the limit left a pin behind")
+	}
+
+	if _, _, err = PinObjects("b", "k1", false); err != nil {
+		t.Fatal(err)
+	}
+	// an object pulled later that would go over the limit stays
+	// evictable
+	if _, _, err = PinObjects("b", "n*", false); err != nil {
+		t.Fatal(err)
+	}
+	putObject(t, "b", "new", 10000, time.Hour)
+	if pinned("b", "new") || PinnedBytes() != one {
+		t.Errorf("new is pinned over the limit; %d bytes pinned", PinnedBytes())
+	}
+}
+
+func TestPinMakers(t *testing.T) {
+	newIndex(t)
+	putObject(t, "b", "k", 10000, time.Hour)
+	PinObjects("b", "k", false)
+	if _, _, err := PinObjects("b", "k", true); err != nil {
+		t.Fatal(err)
+	}
+	if !HasPin("b", "k", false) || !HasPin("b", "k", true) || len(Pins()) != 1 {
+		t.Fatalf("pins %+v, want one made by both", Pins())
+	}
+
+	// the pin lasts until both makers drop it
+	UnpinObjects("b", "k", true)
+	if !pinned("b", "k") || HasPin("b", "k", true) {
+		t.Error("SETB revert dropped the pin made by PIN")
+	}
+	count, _, err := UnpinObjects("b", "k", false)
+	if err != nil || count != 1 || pinned("b", "k") || PinnedBytes() != 0 {
+		t.Errorf("UnpinObjects = %d, %v; %d bytes still pinned", count, err, PinnedBytes())
+	}
+	if e := victim(false); e == nil || e.Key != "k" {
+		t.Error("an unpinned object is not evictable again")
+	}
+}
+
+func TestPinsSaved(t *testing.T) {
+	newIndex(t)
+	PinObjects("b", "a*", false)
+	PinObjects("b", "s*", true)
+
+	pins = nil
+	if err := loadPins(); err != nil {
+		t.Fatal(err)
+	}
+	if !HasPin("b", "a*", false) || !HasPin("b", "s*", true) || HasPin("b", "s*", false) {
+		t.Errorf("pins loaded as %+v", Pins())
+	}
+
+	// pins saved before they had makers were made by PIN
+	ioutil.WriteFile(PINFILE, []byte(`[{"Bucket":"b","Pattern":"old*"}]`), 0644)
+	pins = nil
+	if err := loadPins(); err != nil {
+		t.Fatal(err)
+	}
+	if !HasPin("b", "old*", false) {
+		t.Errorf("old pin loaded as %+v", Pins())
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math"
+	"s3pool/conf"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An eviction policy orders the entries of a heap; the least entry is
+// evicted first.
+//
+//	lru  - least recently used
+//	lfu  - least frequently used, ties broken by lru
+//	size - lru where each doubling of the object size counts as
+//	       SIZEWEIGHT of extra age, so big cold objects go first
+//	arc  - adaptive replacement: lru within the RECENT and FREQUENT
+//	       segments, with a target size for RECENT that grows when
+//	       an object evicted from RECENT comes back and shrinks when
+//	       one evicted from FREQUENT comes back
+type policyType struct {
+	name      string
+	segmented bool // evict from the segment chosen by segment()
+	less      func(a, b *Entry) bool
+}
+
+const SIZEWEIGHT = time.Hour
+
+// # of names remembered in each ghost list of arc
+const GHOSTMAX = 100000
+
+func lruLess(a, b *Entry) bool {
+	return a.Atime.Before(b.Atime)
+}
+
+func lfuLess(a, b *Entry) bool {
+	if a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return lruLess(a, b)
+}
+
+func sizeLess(a, b *Entry) bool {
+	age := func(e *Entry) time.Time {
+		return e.Atime.Add(-time.Duration(math.Log2(float64(e.total()+1)) * float64(SIZEWEIGHT)))
+	}
+	return age(a).Before(age(b))
+}
+
+var policies = map[string]*policyType{
+	"lru":  {"lru", false, lruLess},
+	"lfu":  {"lfu", false, lfuLess},
+	"size": {"size", false, sizeLess},
+	"arc":  {"arc", true, lruLess},
+}
+
+var policy = policies["lru"]
+
+// names recently evicted from the RECENT and FREQUENT segments, oldest
+// first
+type ghostList struct {
+	elem  map[string]*list.Element // of each name in order
+	order *list.List               // of *ghostEntry
+	total int64
+}
+
+type ghostEntry struct {
+	name  string
+	bytes int64
+}
+
+var ghost = [2]*ghostList{newGhostList(), newGhostList()}
+var arcTarget int64 // target bytes of the RECENT segment
+
+func newGhostList() *ghostList {
+	return &ghostList{elem: make(map[string]*list.Element), order: list.New()}
+}
+
+func (g *ghostList) has(name string) bool {
+	_, ok := g.elem[name]
+	return ok
+}
+
+func (g *ghostList) add(name string, nbytes int64) {
+	if g.has(name) {
+		return
+	}
+	g.elem[name] = g.order.PushBack(&ghostEntry{name, nbytes})
+	g.total += nbytes
+	for g.order.Len() > GHOSTMAX {
+		g.remove(g.order.Front().Value.(*ghostEntry).name)
+	}
+}
+
+func (g *ghostList) remove(name string) {
+	if el, ok := g.elem[name]; ok {
+		g.total -= g.order.Remove(el).(*ghostEntry).bytes
+		delete(g.elem, name)
+	}
+}
+
+// Which segment should give up its victim? Caller must hold mux.
+func (p *policyType) segment() int {
+	if segBytes[RECENT] > arcTarget {
+		return RECENT
+	}
+	return FREQUENT
+}
+
+// Called before e enters the index. Caller must hold mux.
+func (p *policyType) admit(e *Entry) {
+	if !p.segmented {
+		return
+	}
+	name := entryName(e.Bucket, e.Key)
+	capacity := segBytes[RECENT] + segBytes[FREQUENT] + e.total()
+	ratio := func(a, b int64) int64 {
+		if b == 0 || a < b {
+			return 1
+		}
+		return a / b
+	}
+	if ghost[RECENT].has(name) {
+		// recency would have kept it: grow RECENT
+		arcTarget += e.total() * ratio(ghost[FREQUENT].total, ghost[RECENT].total)
+		if arcTarget > capacity {
+			arcTarget = capacity
+		}
+		ghost[RECENT].remove(name)
+		if e.Hits < 2 {
+			e.Hits = 2
+		}
+	} else if ghost[FREQUENT].has(name) {
+		// frequency would have kept it: shrink RECENT
+		arcTarget -= e.total() * ratio(ghost[RECENT].total, ghost[FREQUENT].total)
+		if arcTarget < 0 {
+			arcTarget = 0
+		}
+		ghost[FREQUENT].remove(name)
+		if e.Hits < 2 {
+			e.Hits = 2
+		}
+	}
+}
+
+// Called after e was evicted. Caller must hold mux.
+func (p *policyType) evicted(e *Entry) {
+	if p.segmented {
+		ghost[e.seg].add(entryName(e.Bucket, e.Key), e.total())
+	}
+}
+
+// Return the names of the eviction policies
+func Policies() []string {
+	var ret []string
+	for name := range policies {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Switch to the eviction policy name and reorder the heaps
+func SetPolicy(name string) error {
+	p := policies[strings.ToLower(name)]
+	if p == nil {
+		return fmt.Errorf("Unknown eviction policy %s; expects one of %s",
+			name, strings.Join(Policies(), ", "))
+	}
+
+	mux.Lock()
+	policy = p
+	for _, b := range buckets {
+		heap.Init(&b.seg[RECENT])
+		heap.Init(&b.seg[FREQUENT])
+	}
+	mux.Unlock()
+
+	conf.EvictPolicy = p.name
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Start over with an empty index on one device under policy name
+func reset(t *testing.T, name string) {
+	mux.Lock()
+	defer mux.Unlock()
+	usage = make([]int64, 1)
+	segBytes = [2]int64{}
+	entries = map[string]*Entry{}
+	buckets = map[string]*bucketIndex{}
+	ghost = [2]*ghostList{newGhostList(), newGhostList()}
+	arcTarget = 0
+	pins = nil
+	pinnedBytes = 0
+	policy = policies[name]
+	t.Cleanup(func() { policy = policies["lru"] })
+}
+
+var epoch = time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func entry(key string, age time.Duration, hits, nbytes int64) *Entry {
+	return &Entry{Bucket: "b", Key: key, Bytes: []int64{nbytes}, Atime: epoch.Add(-age), Hits: hits}
+}
+
+func TestLess(t *testing.T) {
+	old := entry("old", 2*time.Hour, 5, 1000)
+	hot := entry("hot", time.Hour, 9, 1000)
+	cold := entry("cold", time.Minute, 1, 1000)
+	big := entry("big", time.Minute, 1, 1<<30)
+
+	for _, c := range []struct {
+		name string
+		less func(a, b *Entry) bool
+		a, b *Entry
+	}{
+		{"lru", lruLess, old, hot},
+		{"lru", lruLess, hot, cold},
+		{"lfu", lfuLess, cold, old},
+		{"lfu", lfuLess, old, hot},
+		{"lfu", lfuLess, old, entry("young", 0, 5, 1000)},
+		{"size", sizeLess, big, old},
+		{"size", sizeLess, old, cold},
+	} {
+		if !c.less(c.a, c.b) || c.less(c.b, c.a) {
+			t.Errorf("%s: %s should go before %s", c.name, c.a.Key, c.b.Key)
+		}
+	}
+}
+
+func TestVictim(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		want   string
+	}{
+		{"lru", "old"},
+		{"lfu", "cold"},
+		{"size", "big"},
+	} {
+		reset(t, c.policy)
+		mux.Lock()
+		insert(entry("old", 2*time.Hour, 5, 1000))
+		insert(entry("hot", time.Hour, 9, 1000))
+		insert(entry("cold", time.Minute, 1, 1000))
+		insert(entry("big", 30*time.Minute, 2, 1<<30))
+		e := victim(false)
+		mux.Unlock()
+		if e == nil || e.Key != c.want {
+			t.Errorf("%s: victim is %v, want %s", c.policy, e, c.want)
+		}
+	}
+}
+
+func TestQuotaVictim(t *testing.T) {
+	reset(t, "lru")
+	mux.Lock()
+	defer mux.Unlock()
+	insert(entry("old", 2*time.Hour, 1, 1000))
+	e := entry("new", time.Minute, 1, 1000)
+	e.Bucket = "over"
+	insert(e)
+	quotas = map[string]int64{"over": 500}
+	defer func() { quotas = map[string]int64{} }()
+	if v := victim(true); v != e {
+		t.Errorf("victim over quota is %v, want %v", v, e)
+	}
+}
+
+func TestArcSegments(t *testing.T) {
+	reset(t, "arc")
+	mux.Lock()
+	defer mux.Unlock()
+	insert(entry("once", time.Minute, 1, 1000))
+	insert(entry("twice", 2*time.Hour, 2, 1000))
+	if segBytes[RECENT] != 1000 || segBytes[FREQUENT] != 1000 {
+		t.Fatalf("segments hold %v bytes, want 1000 each", segBytes)
+	}
+
+	// RECENT is over its target of 0, so it gives up its victim even
+	// though the FREQUENT entry is older
+	if e := victim(false); e == nil || e.Key != "once" {
+		t.Errorf("victim is %v, want once", e)
+	}
+	arcTarget = 1000
+	if e := victim(false); e == nil || e.Key != "twice" {
+		t.Errorf("victim is %v, want twice", e)
+	}
+}
+
+func TestArcAdmit(t *testing.T) {
+	reset(t, "arc")
+	mux.Lock()
+	defer mux.Unlock()
+	insert(entry("a", time.Minute, 1, 1000))
+	insert(entry("b", time.Minute, 2, 1000))
+
+	// a name evicted from RECENT comes back: RECENT grows
+	ghost[RECENT].add("b:x", 500)
+	e := entry("x", 0, 1, 500)
+	policy.admit(e)
+	if arcTarget != 500 {
+		t.Errorf("arcTarget is %d, want 500", arcTarget)
+	}
+	if e.Hits != 2 || ghost[RECENT].has("b:x") {
+		t.Errorf("ghost not taken back: hits %d, in ghost %v", e.Hits, ghost[RECENT].has("b:x"))
+	}
+
+	// a name evicted from FREQUENT comes back: RECENT shrinks
+	ghost[FREQUENT].add("b:y", 800)
+	policy.admit(entry("y", 0, 1, 800))
+	if arcTarget != 0 {
+		t.Errorf("arcTarget is %d, want 0", arcTarget)
+	}
+
+	// a new name leaves the target alone
+	policy.admit(entry("z", 0, 1, 800))
+	if arcTarget != 0 {
+		t.Errorf("arcTarget is %d, want 0", arcTarget)
+	}
+}
+
+func TestGhostList(t *testing.T) {
+	g := newGhostList()
+	g.add("a", 10)
+	g.add("b", 20)
+	g.add("a", 10)
+	if g.order.Len() != 2 || g.total != 30 {
+		t.Fatalf("ghost list has %d names and %d bytes, want 2 and 30", g.order.Len(), g.total)
+	}
+
+	// a name removed and added again goes to the back of the order
+	g.remove("a")
+	g.remove("nosuch")
+	if g.has("a") || g.total != 20 {
+		t.Fatalf("a still in ghost list: has %v, total %d", g.has("a"), g.total)
+	}
+	g.add("a", 10)
+	if front := g.order.Front().Value.(*ghostEntry).name; front != "b" {
+		t.Errorf("oldest name is %s, want b", front)
+	}
+
+	// the oldest names are dropped past GHOSTMAX
+	for i := 0; i < GHOSTMAX; i++ {
+		g.add(fmt.Sprint("k", i), 1)
+	}
+	if g.order.Len() != GHOSTMAX || len(g.elem) != GHOSTMAX {
+		t.Errorf("ghost list has %d names, want %d", g.order.Len(), GHOSTMAX)
+	}
+	if g.has("a") || g.has("b") || !g.has("k0") {
+		t.Errorf("ghost list dropped the wrong names")
+	}
+	if g.total != GHOSTMAX {
+		t.Errorf("ghost list has %d bytes, want %d", g.total, GHOSTMAX)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Settings given per bucket with SETB, overriding the global ones.
+// They are saved in BUCKETFILE in the homedir on every change and
+// loaded at startup. A zero value means the global setting applies.
+
+const BUCKETFILE = "buckets.json"
+
+type BucketConf struct {
+	RefreshInterval int      `json:"refresh_interval,omitempty"` // minutes
+	Backend         string   `json:"backend,omitempty"`          // s3, gcs, hdfs, hdfs2x or local
+	Endpoint        string   `json:"endpoint,omitempty"`         // s3 endpoint url, hdfs namenode or local source dir
+	Profile         string   `json:"profile,omitempty"`          // aws credentials profile
+	Quota           int64    `json:"quota,omitempty"`            // max bytes cached
+	Pin             []string `json:"pin,omitempty"`              // glob patterns of keys to keep cached
+	Filespec        string   `json:"filespec,omitempty"`         // default filespec of PULL and PREFETCH
+	Schema          string   `json:"schema,omitempty"`           // default schema file of PULL and PREFETCH
+}
+
+// Names of the settings of SETB
+var BucketSettingNames = []string{
+	"backend", "endpoint", "filespec", "pin", "profile", "quota", "refresh_interval", "schema",
+}
+
+var backendName = map[int]string{
+	DFS_S3:     "s3",
+	DFS_HDFS:   "hdfs",
+	DFS_HDFS2X: "hdfs2x",
+	DFS_LOCAL:  "local",
+	DFS_GCS:    "gcs",
+}
+
+var buckets = struct {
+	sync.Mutex
+	m map[string]*BucketConf
+}{m: make(map[string]*BucketConf)}
+
+func BackendName(mode int) string {
+	return backendName[mode]
+}
+
+func ParseBackend(name string) (int, error) {
+	for mode, s := range backendName {
+		if s == strings.ToLower(name) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown backend %s; expects one of s3, gcs, hdfs, hdfs2x, local", name)
+}
+
+func (bc *BucketConf) copy() BucketConf {
+	ret := *bc
+	ret.Pin = append([]string(nil), bc.Pin...)
+	return ret
+}
+
+// Return the settings of bucket
+func Bucket(bucket string) BucketConf {
+	buckets.Lock()
+	defer buckets.Unlock()
+	if bc := buckets.m[bucket]; bc != nil {
+		return bc.copy()
+	}
+	return BucketConf{}
+}
+
+// Return the settings of all buckets that have some
+func Buckets() map[string]BucketConf {
+	buckets.Lock()
+	defer buckets.Unlock()
+	ret := make(map[string]BucketConf, len(buckets.m))
+	for bucket, bc := range buckets.m {
+		ret[bucket] = bc.copy()
+	}
+	return ret
+}
+
+// Return the sorted names of the buckets that have settings
+func BucketNames() []string {
+	buckets.Lock()
+	defer buckets.Unlock()
+	ret := make([]string, 0, len(buckets.m))
+	for bucket := range buckets.m {
+		ret = append(ret, bucket)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Return the value of setting name of bc as given to SETB
+func (bc *BucketConf) Get(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "refresh_interval":
+		return strconv.Itoa(bc.RefreshInterval), nil
+	case "backend":
+		return bc.Backend, nil
+	case "endpoint":
+		return bc.Endpoint, nil
+	case "profile":
+		return bc.Profile, nil
+	case "quota":
+		return strconv.FormatInt(bc.Quota, 10), nil
+	case "pin":
+		return strings.Join(bc.Pin, " "), nil
+	case "filespec":
+		return bc.Filespec, nil
+	case "schema":
+		return bc.Schema, nil
+	}
+	return "", fmt.Errorf("Unknown bucket setting %s; expects one of %s",
+		name, strings.Join(BucketSettingNames, ", "))
+}
+
+// Parse value into setting name of bc. An empty value clears it.
+func (bc *BucketConf) Set(name, value string) error {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(name) {
+	case "refresh_interval":
+		i := 0
+		if value != "" {
+			var err error
+			if i, err = strconv.Atoi(value); err != nil {
+				return err
+			}
+			if i < 0 {
+				i = 0
+			} else if i > 0 && i < 2 {
+				i = 2 // minimum
+			}
+		}
+		bc.RefreshInterval = i
+	case "backend":
+		if value != "" {
+			mode, err := ParseBackend(value)
+			if err != nil {
+				return err
+			}
+			value = BackendName(mode)
+		}
+		bc.Backend = value
+	case "endpoint":
+		bc.Endpoint = value
+	case "profile":
+		bc.Profile = value
+	case "quota":
+		var n int64
+		if value != "" {
+			var err error
+			if n, err = ParseSize(value); err != nil {
+				return err
+			}
+		}
+		bc.Quota = n
+	case "pin":
+		// patterns delimited by white space
+		bc.Pin = strings.Fields(value)
+	case "filespec":
+		if value != "" && !json.Valid([]byte(value)) {
+			return fmt.Errorf("Invalid JSON in filespec")
+		}
+		bc.Filespec = value
+	case "schema":
+		if value != "" && !filepath.IsAbs(value) {
+			return fmt.Errorf("Schema must be an absolute path")
+		}
+		bc.Schema = value
+	default:
+		_, err := bc.Get(name)
+		return err
+	}
+	return nil
+}
+
+// Change setting name of bucket to value and save the table. Returns
+// the settings of bucket before and after the change.
+func SetBucket(bucket, name, value string) (old, cur BucketConf, err error) {
+	buckets.Lock()
+	defer buckets.Unlock()
+
+	bc := buckets.m[bucket]
+	if bc == nil {
+		bc = &BucketConf{}
+	}
+	old = bc.copy()
+	next := bc.copy()
+	if err = next.Set(name, value); err != nil {
+		return
+	}
+
+	saved := buckets.m[bucket]
+	if next.isZero() {
+		delete(buckets.m, bucket)
+	} else {
+		buckets.m[bucket] = &next
+	}
+	if err = saveBuckets(); err != nil {
+		if saved == nil {
+			delete(buckets.m, bucket)
+		} else {
+			buckets.m[bucket] = saved
+		}
+		return
+	}
+	return old, next.copy(), nil
+}
+
+func (bc *BucketConf) isZero() bool {
+	return bc.RefreshInterval == 0 && bc.Backend == "" && bc.Endpoint == "" &&
+		bc.Profile == "" && bc.Quota == 0 && len(bc.Pin) == 0 &&
+		bc.Filespec == "" && bc.Schema == ""
+}
+
+// Caller must hold buckets
+func saveBuckets() error {
+	byt, err := json.MarshalIndent(buckets.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmppath := BUCKETFILE + ".tmp"
+	if err = ioutil.WriteFile(tmppath, byt, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, BUCKETFILE)
+}
+
+// Load the table saved in BUCKETFILE. A missing file is an empty table.
+func LoadBuckets() error {
+	byt, err := ioutil.ReadFile(BUCKETFILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*BucketConf)
+	if err = json.Unmarshal(byt, &m); err != nil {
+		return fmt.Errorf("%s -- %v", BUCKETFILE, err)
+	}
+	for bucket, bc := range m {
+		if bc.Backend != "" {
+			if _, err = ParseBackend(bc.Backend); err != nil {
+				return fmt.Errorf("%s: bucket %s -- %v", BUCKETFILE, bucket, err)
+			}
+		}
+	}
+	buckets.Lock()
+	buckets.m = m
+	buckets.Unlock()
+	return nil
+}
+
+// Return the refresh interval of bucket in minutes
+func BucketRefreshInterval(bucket string) int {
+	if i := Bucket(bucket).RefreshInterval; i > 0 {
+		return i
+	}
+	return RefreshInterval
+}
+
+// Return the DFS_* mode of the backend of bucket
+func BucketDfsMode(bucket string) int {
+	if name := Bucket(bucket).Backend; name != "" {
+		if mode, err := ParseBackend(name); err == nil {
+			return mode
+		}
+	}
+	return DfsMode
+}
+
+// Return the options of the aws cli for the profile and endpoint of
+// bucket
+func AwsOptions(bucket string) []string {
+	bc := Bucket(bucket)
+	var opt []string
+	if bc.Profile != "" {
+		opt = append(opt, "--profile", bc.Profile)
+	}
+	if bc.Endpoint != "" {
+		opt = append(opt, "--endpoint-url", bc.Endpoint)
+	}
+	return opt
+}
+
+// Return the path of bucket:key on the local filesystem in local mode
+func SourcePath(bucket, key string) string {
+	prefix := SrcPrefix
+	if e := Bucket(bucket).Endpoint; e != "" {
+		prefix = e
+	}
+	return filepath.Join(prefix, bucket, key)
+}
+
+// A PUSH to a local bucket writes the file to a temp file named
+// "." + base + LOCALTEMP + random digits next to it, then renames it
+const LOCALTEMP = ".s3pool_"
+
+// Is the file named base a temp file of a PUSH to a local bucket?
+func IsLocalTemp(base string) bool {
+	return strings.HasPrefix(base, ".") && strings.Contains(base, LOCALTEMP)
+}
+
+// Return the environment of gohdfs for the namenode of bucket; nil
+// means the environment of s3pool
+func HdfsEnv(bucket string) []string {
+	if e := Bucket(bucket).Endpoint; e != "" {
+		return append(os.Environ(), "HADOOP_NAMENODE="+e)
+	}
+	return nil
+}
+
+// Return the generic options of hadoop fs for the namenode of bucket
+func HadoopOptions(bucket string) []string {
+	if e := Bucket(bucket).Endpoint; e != "" {
+		return []string{"-fs", e}
+	}
+	return nil
+}
@@ -12,23 +12,68 @@
  */
 package conf
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var VerboseLevel = 1
-var RefreshInterval = 15 // in minutes
+var RefreshInterval = 15   // in minutes
+var RefreshConcurrency = 4 // max refreshes run by bucketmon at once
 var BucketmonChannel chan<- string
+var BucketmonWaitChannel chan<- string // buckets a request waits on
 var PullConcurrency = 20
+var BackgroundConcurrency = 2 // max pull workers on LOW priority jobs
 var UpSince = time.Now()
 var IsMaster bool
 var Master string
 var Standby string
 var CountPull int64
 var CountPullHit int64
+var CountPullShared int64
 var CountRefresh int64
 var CountPush int64
 var CountGlob int64
+var CountPrefetch int64
+var CountRetry int64
+var CountQuarantine int64
+var HWM = 90 // start eviction when a device is this % full
+var LWM = 75 // evict until a device is this % full
+var EvictPolicy = "lru"
+var PinLimit int64  // max bytes of pinned objects; 0 for no limit
+var LockTimeout int // seconds to wait for a bucket:key lock; 0 waits forever
+
+// seconds a backend command may run before it is killed; 0 for no limit
+var GetTimeout = 3600
+var ListTimeout = 1800
+var PutTimeout = 3600
+var XrgdivTimeout = 3600
+
+var CatalogWait = 1800 // seconds a request waits for the first listing of a bucket
+
+var RetryAttempts = 4 // tries of a backend call that fails for a transient reason
+var RetryDelay = 500  // ms before the first retry; doubles each time
+
+var Verify = true // check downloads against the checksum of the backend
+
+// files at least MultipartThreshold bytes are pushed to s3 in parts
+// of MultipartSize bytes, MultipartConcurrency at once
+var MultipartThreshold int64 = 64 << 20
+var MultipartSize int64 = 64 << 20
+var MultipartConcurrency = 4
+
+var PushMode = "sync" // sync or writeback
+
+var ShutdownTimeout = 60 // seconds to drain requests and jobs on shutdown
+
+// receives the drain timeout in seconds to shut down
+var ShutdownChannel = make(chan int, 1)
 
 var DfsMode int
+var SrcPrefix = "/"          // source directory of buckets in local mode
+var LocalSymlinks = "follow" // follow or skip symbolic links in local mode
 var DFS_S3 int = 1
 var DFS_HDFS int = 2
 var DFS_HDFS2X int = 3
@@ -42,3 +87,34 @@ func Verbose(level int) bool {
 func NotifyBucketmon(bkt string) {
 	BucketmonChannel <- bkt
 }
+
+// Ask bucketmon to refresh bkt at once, for a request waiting on it
+func NotifyBucketmonWaiting(bkt string) {
+	BucketmonWaitChannel <- bkt
+}
+
+// Parse a byte count with an optional K, M, G or T suffix
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("Invalid size %s", s)
+	}
+	return i * mult, nil
+}
@@ -0,0 +1,39 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package conf
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"1234", 1234},
+		{"4k", 4 << 10},
+		{" 10M ", 10 << 20},
+		{"3G", 3 << 30},
+		{"2t", 2 << 40},
+	} {
+		got, err := ParseSize(c.s)
+		if err != nil || got != c.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", c.s, got, err, c.want)
+		}
+	}
+	for _, s := range []string{"", "G", "-1", "1.5G", "10X", "10GB"} {
+		if n, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", s, n)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// The config file gives the command line flags and the settings of SET
+// by name in a JSON object, e.g.
+//
+//	{"port": 7000, "devices": ["/d1", "/d2"], "dfs": "s3", "hwm": 85,
+//	 "quota": ["bucket1=10G"], "retry_delay": 1000}
+//
+// It is read at startup, and again on SIGHUP or RELOAD.
+
+const CONFIGFILE = "s3pool.json"
+
+// Path of the config file in use; empty if none
+var ConfigFile string
+
+// Values of the config file by setting name. A list value has one
+// element per item; any other value has one element.
+type Config map[string][]string
+
+func ReadConfig(path string) (Config, error) {
+	byt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(byt))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s -- %v", path, err)
+	}
+
+	cfg := make(Config, len(m))
+	for name, v := range m {
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		values := make([]string, 0, len(list))
+		for _, x := range list {
+			switch x := x.(type) {
+			case string:
+				values = append(values, x)
+			case json.Number:
+				values = append(values, x.String())
+			case bool:
+				values = append(values, strconv.FormatBool(x))
+			default:
+				return nil, fmt.Errorf("%s: %s -- expects a string, number, boolean or a list of them", path, name)
+			}
+		}
+		cfg[strings.ToLower(name)] = values
+	}
+	return cfg, nil
+}
+
+// Return the value of setting name, with the items of a list delimited
+// by space
+func (cfg Config) Value(name string) string {
+	return strings.Join(cfg[name], " ")
+}
@@ -0,0 +1,68 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package conf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Write the config text to a file and read it back
+func readConfig(t *testing.T, text string) (Config, error) {
+	path := filepath.Join(t.TempDir(), CONFIGFILE)
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadConfig(path)
+}
+
+func TestReadConfig(t *testing.T) {
+	cfg, err := readConfig(t, `{"port": 7000, "Devices": ["/d1", "/d2"], "dfs": "s3",
+		"no_daemon": true, "quota": ["bucket1=10G"], "retry_delay": 1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		"port":        {"7000"},
+		"devices":     {"/d1", "/d2"},
+		"dfs":         {"s3"},
+		"no_daemon":   {"true"},
+		"quota":       {"bucket1=10G"},
+		"retry_delay": {"1000"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ReadConfig returned %v, want %v", cfg, want)
+	}
+	if v := cfg.Value("devices"); v != "/d1 /d2" {
+		t.Errorf("devices is %q, want \"/d1 /d2\"", v)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	for _, text := range []string{
+		`{"port": 7000`,
+		`["port", 7000]`,
+		`{"port": null}`,
+		`{"quota": {"bucket1": "10G"}}`,
+		`{"devices": [["/d1"]]}`,
+	} {
+		if cfg, err := readConfig(t, text); err == nil {
+			t.Errorf("ReadConfig(%s) = %v, want an error", text, cfg)
+		}
+	}
+	if _, err := ReadConfig(filepath.Join(t.TempDir(), "nosuch")); err == nil {
+		t.Error("ReadConfig of a missing file did not fail")
+	}
+}
@@ -13,6 +13,7 @@
 package gcs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,6 +21,9 @@ import (
 	"os"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/version"
 	//"cloud.google.com/go/storage"
 	//"google.golang.org/api/iterator"
 )
@@ -27,7 +31,7 @@ import (
 // Invoke aws s3api to retrieve a file. Form:
 //
 //	aws s3api get-object --bucket BUCKET --key KEY --if-none-match ETAG tmppath
-func GetObject(bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
+func GetObject(ctx context.Context, bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
 	if conf.Verbose(1) {
 		log.Println("gcs get-objects", bucket, key)
 	}
@@ -77,21 +81,77 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	}
 	defer os.Remove(tmppath)
 
-	bkt := g_client.Bucket(bucket)
-	rc, err := bkt.Object(key).NewReader(g_ctx)
-	if err != nil {
-		err = fmt.Errorf("gcs error -- %v", err)
+	ctx, cancel := proc.WithTimeout(ctx, conf.GetTimeout)
+	defer cancel()
+	// the client is created on first use if s3pool does not run in gcs mode
+	if err = Init(); err != nil {
 		return
 	}
-	defer rc.Close()
+	bkt := g_client.Bucket(bucket)
 
-	f, err := os.Create(tmppath)
+	// The etag is the generation of the object
+	var generation int64
+	err = retry.Do(ctx, "gcs attrs", func() error {
+		attrs, err := bkt.Object(key).Attrs(ctx)
+		if err != nil {
+			if terr := proc.Err(ctx, "gcs attrs"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gcs error -- %v", err)
+		}
+		generation = attrs.Generation
+		return nil
+	})
 	if err != nil {
-		err = fmt.Errorf("Cannot open temp file for write -- %v", err)
 		return
 	}
+	newetag := version.Gcs(generation)
+	if etag == newetag {
+		if conf.Verbose(1) {
+			log.Println(" ... gcs object not modified")
+		}
+		if etag != catetag {
+			log.Println(" ... update", key, etag)
+			cat.Upsert(bucket, key, etag)
+		}
+		retpath = path
+		hit = true
+		return
+	}
+
+	var digest string
+	err = retry.Do(ctx, "gcs get", func() error {
+		// read the generation whose etag is recorded
+		rc, err := bkt.Object(key).Generation(generation).NewReader(ctx)
+		if err != nil {
+			if terr := proc.Err(ctx, "gcs get"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gcs error -- %v", err)
+		}
+		defer rc.Close()
+
+		f, err := os.Create(tmppath)
+		if err != nil {
+			return retry.Stop(fmt.Errorf("Cannot open temp file for write -- %v", err))
+		}
+		defer f.Close()
 
-	_, err = io.Copy(f, rc)
+		if _, err = io.Copy(f, rc); err != nil {
+			if terr := proc.Err(ctx, "gcs get"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gcs error -- %v", err)
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		if conf.Verify {
+			digest, err = checkDownload(bucket, key, tmppath, &rc.Attrs)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return
 	}
@@ -102,7 +162,10 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	}
 
 	gspath := "gs://" + bucket + "/" + key
-	etag_content := "0" + " " + gspath
+	etag_content := newetag + " " + gspath
+	if digest != "" {
+		etag_content += " " + digest
+	}
 	// Save the meta info
 	ioutil.WriteFile(metapath, []byte(etag_content), 0644)
 
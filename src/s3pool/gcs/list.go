@@ -14,7 +14,12 @@ package gcs
 
 import (
 	"cloud.google.com/go/storage"
+	"context"
 	"google.golang.org/api/iterator"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/version"
 )
 
 type ListRecord struct {
@@ -26,25 +31,40 @@ type ListCollection struct {
 	Contents []ListRecord
 }
 
-func ListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func ListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return listOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "gcs list", list, notify)
+}
+
+func listOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
 	var err error = nil
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 
+	if err = Init(); err != nil {
+		return err
+	}
 	bkt := g_client.Bucket(bucket)
 	query := &storage.Query{Prefix: prefix}
-	query.SetAttrSelection([]string{"Name"})
+	query.SetAttrSelection([]string{"Name", "Generation"})
 
-	it := bkt.Objects(g_ctx, query)
+	it := bkt.Objects(ctx, query)
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
+			if terr := proc.Err(ctx, "gcs list"); terr != nil {
+				return terr
+			}
 			return err
 		}
 
 		key := attrs.Name
-		etag := "0"
+		etag := version.Gcs(attrs.Generation)
 		notify(key, etag)
 	}
 
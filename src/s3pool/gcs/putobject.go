@@ -13,20 +13,114 @@
 package gcs
 
 import (
-/*
-"bytes"
-"fmt"
-"log"
-"os"
-"os/exec"
-"s3pool/cat"
-"s3pool/conf"
-"s3pool/strlock"
-*/
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/strlock"
+	"s3pool/verify"
+	"s3pool/version"
 )
 
-// aws s3api put-object
-func PutObject(bucket, key, fname string) error {
+// Upload the file fname to gs://bucket/key. The storage client sends
+// it in chunks of a resumable upload, with the CRC32C of the file for
+// the service to check.
+func PutObject(ctx context.Context, bucket, key, fname string) error {
+	if conf.Verbose(1) {
+		log.Println("gcs put", bucket, key, fname)
+	}
+
+	if len(fname) > 0 && fname[0] != '/' {
+		return fmt.Errorf("Filename parameter must be an absolute path")
+	}
+
+	// lock to serialize on (bucket,key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	// the cached object is stale once the upload starts
+	if err = cache.Remove(bucket, key); err != nil {
+		return err
+	}
+
+	etag, meta, err := Upload(ctx, bucket, key, fname)
+	if err != nil {
+		return err
+	}
+
+	// keep the file pushed as the cached object, so that the next
+	// PULL does not fetch it again
+	if err = cache.Keep(bucket, key, fname, meta); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
+	}
 
+	// reflect the new file in our catalog
+	cat.Upsert(bucket, key, etag)
 	return nil
 }
+
+// Upload the file fname to gs://bucket/key without touching the cache.
+// Returns the etag of the object uploaded and the content of its meta
+// file.
+func Upload(ctx context.Context, bucket, key, fname string) (etag string, meta []byte, err error) {
+	crc, err := verify.CRC32C(fname)
+	if err != nil {
+		return
+	}
+
+	// push the file to GCS
+	ctx, cancel := proc.WithTimeout(ctx, conf.PutTimeout)
+	defer cancel()
+	if err = Init(); err != nil {
+		return
+	}
+	bkt := g_client.Bucket(bucket)
+	var generation int64
+	err = retry.Do(ctx, "gcs put", func() error {
+		f, err := os.Open(fname)
+		if err != nil {
+			return retry.Stop(err)
+		}
+		defer f.Close()
+
+		// a writer is only abandoned by cancelling its context
+		wctx, wcancel := context.WithCancel(ctx)
+		defer wcancel()
+		w := bkt.Object(key).NewWriter(wctx)
+		w.CRC32C = crc
+		w.SendCRC32C = true
+		if _, err = io.Copy(w, f); err != nil {
+			wcancel()
+			w.Close()
+			if terr := proc.Err(ctx, "gcs put"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gcs error -- %v", err)
+		}
+		if err = w.Close(); err != nil {
+			if terr := proc.Err(ctx, "gcs put"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gcs error -- %v", err)
+		}
+		generation = w.Attrs().Generation
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// the etag is the generation written, as GetObject records it
+	etag = version.Gcs(generation)
+	meta = []byte(etag + " gs://" + bucket + "/" + key)
+	return
+}
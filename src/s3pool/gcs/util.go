@@ -20,13 +20,20 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	//"google.golang.org/api/iterator"
 )
 
 var g_ctx context.Context
 var g_client *storage.Client = nil
+var g_mux sync.Mutex
 
 func Init() error {
+	g_mux.Lock()
+	defer g_mux.Unlock()
+	if g_client != nil {
+		return nil
+	}
 	var err error = nil
 	g_ctx = context.Background()
 	g_client, err = storage.NewClient(g_ctx)
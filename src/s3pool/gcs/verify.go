@@ -0,0 +1,49 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package gcs
+
+import (
+	"cloud.google.com/go/storage"
+	"fmt"
+	"s3pool/verify"
+	"strconv"
+)
+
+// Check the download at tmppath of bucket:key against the size and
+// CRC32C of the object in attrs. Returns the digest verified.
+func checkDownload(bucket, key, tmppath string, attrs *storage.ReaderObjectAttrs) (string, error) {
+	// an object stored gzipped is served decompressed, so neither its
+	// size nor its CRC32C are those of the download
+	if attrs.ContentEncoding == "gzip" {
+		return "", nil
+	}
+
+	size, err := verify.Size(tmppath)
+	if err != nil {
+		return "", err
+	}
+	want, got := strconv.FormatInt(attrs.Size, 10), strconv.FormatInt(size, 10)
+	if err = verify.Match(bucket, key, tmppath, "size", want, got); err != nil {
+		return "", err
+	}
+
+	crc, err := verify.CRC32C(tmppath)
+	if err != nil {
+		return "", err
+	}
+	want, got = fmt.Sprintf("%08x", attrs.CRC32C), fmt.Sprintf("%08x", crc)
+	if err = verify.Match(bucket, key, tmppath, "crc32c", want, got); err != nil {
+		return "", err
+	}
+	return "crc32c:" + got, nil
+}
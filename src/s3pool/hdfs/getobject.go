@@ -14,14 +14,16 @@ package hdfs
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
-	"os/exec"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 )
 
 //
@@ -29,7 +31,7 @@ import (
 //
 //   aws s3api get-object --bucket BUCKET --key KEY --if-none-match ETAG tmppath
 //
-func GetObject(bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
+func GetObject(ctx context.Context, bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
 	if conf.Verbose(1) {
 		log.Println("gohdfs get", bucket, key)
 	}
@@ -81,14 +83,27 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 
 	dfspath := "/" + bucket + "/" + key
 
+	ctx, cancel := proc.WithTimeout(ctx, conf.GetTimeout)
+	defer cancel()
+
 	var outbuf, errbuf bytes.Buffer
 	// Run checksum command
-	cmd := exec.Command("gohdfs", "checksum", dfspath)
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-	if err = cmd.Run(); err != nil {
-		errstr := string(errbuf.Bytes())
-		err = fmt.Errorf("gohdfs get failed -- %s", errstr)
+	err = retry.Do(ctx, "gohdfs checksum", func() error {
+		outbuf.Reset()
+		errbuf.Reset()
+		cmd := proc.Command(ctx, "gohdfs", "checksum", dfspath)
+		cmd.Env = conf.HdfsEnv(bucket)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "gohdfs checksum"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gohdfs get failed -- %s", errbuf.String())
+		}
+		return nil
+	})
+	if err != nil {
 		return
 	}
 
@@ -116,14 +131,28 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	}
 
 
-	errbuf.Reset()
-
 	// Run GET command
-	cmd = exec.Command("gohdfs", "get", dfspath, tmppath)
-	cmd.Stderr = &errbuf
-	if err = cmd.Run(); err != nil {
-		errstr := string(errbuf.Bytes())
-		err = fmt.Errorf("gohdfs get failed -- %s", errstr)
+	var digest string
+	err = retry.Do(ctx, "gohdfs get", func() error {
+		errbuf.Reset()
+		os.Remove(tmppath)
+		cmd := proc.Command(ctx, "gohdfs", "get", dfspath, tmppath)
+		cmd.Env = conf.HdfsEnv(bucket)
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "gohdfs get"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gohdfs get failed -- %s", errbuf.String())
+		}
+		if conf.Verify {
+			var err error
+			digest, err = checkDownload(ctx, bucket, key, dfspath, tmppath, newetag)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return
 	}
 
@@ -133,7 +162,11 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	}
 
 	// Save the meta info
-	ioutil.WriteFile(metapath, outbuf.Bytes(), 0644)
+	meta := outbuf.Bytes()
+	if digest != "" {
+		meta = []byte(strings.TrimRight(string(meta), "\n") + " " + digest + "\n")
+	}
+	ioutil.WriteFile(metapath, meta, 0644)
 
 	// Update catalog with the new etag
 	etag = extractETag(metapath)
@@ -0,0 +1,130 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package hdfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/strlock"
+	"strings"
+)
+
+// Upload the file fname to /bucket/key. gohdfs put does not overwrite,
+// so the file is put under a temporary name next to its destination
+// and moved over it.
+func PutObject(ctx context.Context, bucket, key, fname string) error {
+	if conf.Verbose(1) {
+		log.Println("gohdfs put", bucket, key, fname)
+	}
+
+	if len(fname) > 0 && fname[0] != '/' {
+		return fmt.Errorf("Filename parameter must be an absolute path")
+	}
+
+	// lock to serialize on (bucket,key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	// the cached object is stale once the upload starts
+	if err = cache.Remove(bucket, key); err != nil {
+		return err
+	}
+
+	etag, meta, err := Upload(ctx, bucket, key, fname)
+	if err != nil {
+		return err
+	}
+
+	// keep the file pushed as the cached object, so that the next
+	// PULL does not fetch it again
+	if err = cache.Keep(bucket, key, fname, meta); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
+	}
+
+	// reflect the new file in our catalog
+	cat.Upsert(bucket, key, etag)
+	return nil
+}
+
+// Upload the file fname to /bucket/key without touching the cache.
+// Uploads of the same key must not run at once. Returns the etag of
+// the file uploaded and the content of its meta file.
+func Upload(ctx context.Context, bucket, key, fname string) (etag string, meta []byte, err error) {
+	dfspath := "/" + bucket + "/" + key
+	tmppath := path.Join(path.Dir(dfspath), fmt.Sprintf(".%s.s3pool_%d", path.Base(dfspath), os.Getpid()))
+
+	// push the file to HDFS
+	ctx, cancel := proc.WithTimeout(ctx, conf.PutTimeout)
+	defer cancel()
+	var outbuf bytes.Buffer
+	gohdfs := func(args ...string) error {
+		var errbuf bytes.Buffer
+		outbuf.Reset()
+		cmd := proc.Command(ctx, "gohdfs", args...)
+		cmd.Env = conf.HdfsEnv(bucket)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "gohdfs "+args[0]); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("gohdfs %s failed -- %s", args[0], errbuf.String())
+		}
+		return nil
+	}
+	err = retry.Do(ctx, "gohdfs put", func() error {
+		// a failed try may leave the temporary file behind
+		if err := gohdfs("rm", "-f", tmppath); err != nil {
+			return err
+		}
+		if err := gohdfs("mkdir", "-p", path.Dir(dfspath)); err != nil {
+			return err
+		}
+		if err := gohdfs("put", fname, tmppath); err != nil {
+			return err
+		}
+		return gohdfs("mv", "-T", tmppath, dfspath)
+	})
+	if err != nil {
+		return
+	}
+
+	// the etag is the checksum of the file put, and the output of
+	// gohdfs checksum is the meta file, as GetObject records them
+	err = retry.Do(ctx, "gohdfs checksum", func() error {
+		return gohdfs("checksum", dfspath)
+	})
+	if err != nil {
+		return
+	}
+	meta = append([]byte(nil), outbuf.Bytes()...)
+	nv := strings.SplitN(string(meta), " ", 2)
+	if len(nv) != 2 {
+		err = fmt.Errorf("gohdfs checksum output format error")
+		return
+	}
+	etag = nv[0]
+	return
+}
@@ -0,0 +1,61 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package hdfs
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"s3pool/conf"
+	"s3pool/hdfs2x"
+	"s3pool/verify"
+)
+
+// Check the download at tmppath of bucket:key against want, the
+// checksum that gohdfs reports for dfspath. gohdfs does not tell the
+// block size and bytes per CRC that the checksum was computed with,
+// so they are read from hadoop fs -checksum. The download is not
+// checked if the hadoop client is not installed, or the file has a
+// checksum of another form. Returns the digest verified.
+func checkDownload(ctx context.Context, bucket, key, dfspath, tmppath, want string) (string, error) {
+	if _, err := exec.LookPath("hadoop"); err != nil {
+		if conf.Verbose(1) {
+			log.Println(" ... cannot check", dfspath, "without the hadoop client")
+		}
+		return "", nil
+	}
+	algo, _, err := hdfs2x.Checksum(ctx, bucket, dfspath)
+	if err != nil {
+		return "", err
+	}
+	blockSize, bytesPerCRC, castagnoli, ok := verify.ParseHdfsChecksum(algo)
+	if !ok {
+		if conf.Verbose(1) {
+			log.Println(" ... cannot check checksum", algo, "of", dfspath)
+		}
+		return "", nil
+	}
+
+	got, err := verify.HdfsMD5(tmppath, blockSize, bytesPerCRC, castagnoli)
+	if err != nil {
+		return "", err
+	}
+	name := "md5md5crc32"
+	if castagnoli {
+		name = "md5md5crc32c"
+	}
+	if err = verify.Match(bucket, key, tmppath, name, want, got); err != nil {
+		return "", err
+	}
+	return name + ":" + got, nil
+}
@@ -14,20 +14,23 @@ package hdfs2x
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	//"strings"
-	"os/exec"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/version"
 )
 
 // Invoke aws s3api to retrieve a file. Form:
 //
 //	aws s3api get-object --bucket BUCKET --key KEY --if-none-match ETAG tmppath
-func GetObject(bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
+func GetObject(ctx context.Context, bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
 	if conf.Verbose(1) {
 		log.Println("hadoop fs -get", bucket, key)
 	}
@@ -80,8 +83,19 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 
 	dfspath := "/" + bucket + "/" + key
 
-	// Remote checksum always equals to zero
-	newetag := "0"
+	ctx, cancel := proc.WithTimeout(ctx, conf.GetTimeout)
+	defer cancel()
+
+	// The etag is the length and modification time of the file
+	var newetag string
+	err = retry.Do(ctx, "hadoop fs -stat", func() error {
+		var err error
+		newetag, err = version.HdfsFile(ctx, bucket, dfspath)
+		return err
+	})
+	if err != nil {
+		return
+	}
 	if etag == newetag {
 		err = nil
 		if conf.Verbose(1) {
@@ -100,12 +114,29 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 
 	// Run GET command
 	var outbuf, errbuf bytes.Buffer
-	cmd := exec.Command("hadoop", "fs", "-get", dfspath, tmppath)
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-	if err = cmd.Run(); err != nil {
-		errstr := string(errbuf.Bytes())
-		err = fmt.Errorf("hadoop fs -get failed -- %s", errstr)
+	var digest string
+	err = retry.Do(ctx, "hadoop fs -get", func() error {
+		outbuf.Reset()
+		errbuf.Reset()
+		os.Remove(tmppath) // a failed try may leave it behind
+		args := append([]string{"fs"}, conf.HadoopOptions(bucket)...)
+		cmd := proc.Command(ctx, "hadoop", append(args, "-get", dfspath, tmppath)...)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "hadoop fs -get"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("hadoop fs -get failed -- %s", errbuf.String())
+		}
+		if conf.Verify {
+			var err error
+			digest, err = checkDownload(ctx, bucket, key, dfspath, tmppath)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return
 	}
 
@@ -114,7 +145,10 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 		return
 	}
 
-	etag_content := "0" + " " + dfspath
+	etag_content := newetag + " " + dfspath
+	if digest != "" {
+		etag_content += " " + digest
+	}
 	// Save the meta info
 	ioutil.WriteFile(metapath, []byte(etag_content), 0644)
 
@@ -15,8 +15,12 @@ package hdfs2x
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"strings"
 )
 
@@ -29,8 +33,17 @@ type ListCollection struct {
 	Contents []ListRecord
 }
 
-func ListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func ListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return listOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "gohdfs checksum", list, notify)
+}
+
+func listOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
 	var err error
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 	var path string
 	var cmd *exec.Cmd
 
@@ -39,7 +52,8 @@ func ListObjects(bucket string, prefix string, notify func(key, etag string)) er
 	} else {
 		path = "hdfs://" + bucket + "/" + prefix
 	}
-	cmd = exec.Command("gohdfs", "checksum", path)
+	cmd = proc.Command(ctx, "gohdfs", "checksum", path)
+	cmd.Env = conf.HdfsEnv(bucket)
 
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -75,7 +89,10 @@ func ListObjects(bucket string, prefix string, notify func(key, etag string)) er
 
 	// clean up
 	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("gohdfs checksum failed -- %v", err)
+		if terr := proc.Err(ctx, "gohdfs checksum"); terr != nil {
+			return terr
+		}
+		return fmt.Errorf("gohdfs checksum failed -- %v %s", err, errbuf.String())
 	}
 
 	return nil
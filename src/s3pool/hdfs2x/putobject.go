@@ -0,0 +1,111 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package hdfs2x
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/strlock"
+	"s3pool/version"
+)
+
+// Upload the file fname to /bucket/key with hadoop fs -put, which
+// writes to a temporary file and renames it over the destination.
+func PutObject(ctx context.Context, bucket, key, fname string) error {
+	if conf.Verbose(1) {
+		log.Println("hadoop fs -put", bucket, key, fname)
+	}
+
+	if len(fname) > 0 && fname[0] != '/' {
+		return fmt.Errorf("Filename parameter must be an absolute path")
+	}
+
+	// lock to serialize on (bucket,key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	// the cached object is stale once the upload starts
+	if err = cache.Remove(bucket, key); err != nil {
+		return err
+	}
+
+	etag, meta, err := Upload(ctx, bucket, key, fname)
+	if err != nil {
+		return err
+	}
+
+	// keep the file pushed as the cached object, so that the next
+	// PULL does not fetch it again
+	if err = cache.Keep(bucket, key, fname, meta); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
+	}
+
+	// reflect the new file in our catalog
+	cat.Upsert(bucket, key, etag)
+	return nil
+}
+
+// Upload the file fname to /bucket/key without touching the cache.
+// Returns the etag of the file uploaded and the content of its meta
+// file.
+func Upload(ctx context.Context, bucket, key, fname string) (etag string, meta []byte, err error) {
+	dfspath := "/" + bucket + "/" + key
+
+	// push the file to HDFS
+	ctx, cancel := proc.WithTimeout(ctx, conf.PutTimeout)
+	defer cancel()
+	hadoop := func(args ...string) error {
+		var errbuf bytes.Buffer
+		cmd := proc.Command(ctx, "hadoop", append(append([]string{"fs"}, conf.HadoopOptions(bucket)...), args...)...)
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "hadoop fs "+args[0]); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("hadoop fs %s failed -- %s", args[0], errbuf.String())
+		}
+		return nil
+	}
+	err = retry.Do(ctx, "hadoop fs -put", func() error {
+		if err := hadoop("-mkdir", "-p", path.Dir(dfspath)); err != nil {
+			return err
+		}
+		return hadoop("-put", "-f", fname, dfspath)
+	})
+	if err != nil {
+		return
+	}
+
+	// the etag is the length and modification time of the file put
+	err = retry.Do(ctx, "hadoop fs -stat", func() error {
+		var err error
+		etag, err = version.HdfsFile(ctx, bucket, dfspath)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	meta = []byte(etag + " " + dfspath)
+	return
+}
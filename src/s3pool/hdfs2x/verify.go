@@ -0,0 +1,92 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package hdfs2x
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/verify"
+	"strings"
+)
+
+// Return the checksum that hadoop fs -checksum reports for dfspath,
+// as its algorithm name and its value in hex. The output is of the
+// form
+//
+//	dfspath	MD5-of-<crcPerBlock>MD5-of-<bytesPerCRC>CRC32C	<hex>
+//
+// where the MD5 is the last 32 digits of hex.
+func Checksum(ctx context.Context, bucket, dfspath string) (algo, hex string, err error) {
+	var outbuf, errbuf bytes.Buffer
+	err = retry.Do(ctx, "hadoop fs -checksum", func() error {
+		outbuf.Reset()
+		errbuf.Reset()
+		args := append([]string{"fs"}, conf.HadoopOptions(bucket)...)
+		cmd := proc.Command(ctx, "hadoop", append(args, "-checksum", dfspath)...)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "hadoop fs -checksum"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("hadoop fs -checksum failed -- %s", errbuf.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	f := strings.Fields(outbuf.String())
+	if len(f) < 3 {
+		return "", "", fmt.Errorf("hadoop fs -checksum output format error")
+	}
+	return f[len(f)-2], f[len(f)-1], nil
+}
+
+// Check the download at tmppath of bucket:key against the checksum
+// that hadoop fs -checksum reports for dfspath. Files with a checksum
+// of another form than MD5MD5CRC32(C), such as COMPOSITE-CRC32C, are
+// not checked. Returns the digest verified.
+func checkDownload(ctx context.Context, bucket, key, dfspath, tmppath string) (string, error) {
+	algo, hex, err := Checksum(ctx, bucket, dfspath)
+	if err != nil {
+		return "", err
+	}
+	blockSize, bytesPerCRC, castagnoli, ok := verify.ParseHdfsChecksum(algo)
+	if !ok || len(hex) < 32 {
+		if conf.Verbose(1) {
+			log.Println(" ... cannot check checksum", algo, "of", dfspath)
+		}
+		return "", nil
+	}
+	want := hex[len(hex)-32:]
+
+	got, err := verify.HdfsMD5(tmppath, blockSize, bytesPerCRC, castagnoli)
+	if err != nil {
+		return "", err
+	}
+	name := "md5md5crc32"
+	if castagnoli {
+		name = "md5md5crc32c"
+	}
+	if err = verify.Match(bucket, key, tmppath, name, want, got); err != nil {
+		return "", err
+	}
+	return name + ":" + got, nil
+}
@@ -13,35 +13,123 @@
 package jobqueue
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 )
 
+// Job priorities. A worker always takes a job of the highest priority
+// available. Within a priority, the clients that submitted jobs take
+// turns, so one client with many jobs cannot starve the others.
+const (
+	HIGH      = 0
+	NORMAL    = 1
+	LOW       = 2
+	NPRIORITY = 3
+)
+
+var priorityName = [NPRIORITY]string{"high", "normal", "low"}
+
+// Returned by AddPriority once Destroy was called, as no worker is left
+// to run the job
+var ErrClosed = errors.New("job queue is closed")
+
+func PriorityName(pri int) string {
+	return priorityName[pri]
+}
+
+func ParsePriority(s string) (int, error) {
+	for i, name := range priorityName {
+		if strings.ToLower(s) == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown priority %s", s)
+}
+
 type Item struct {
+	pri         int
 	idx         int
 	processItem func(idx int)
 }
 
+// jobs of one client at one priority
+type clientQueue struct {
+	name string
+	item []*Item
+}
+
+// jobs of one priority
+type level struct {
+	client  map[string]*clientQueue
+	ring    []*clientQueue // clients with jobs, in turn order
+	next    int            // whose turn in ring
+	count   int            // # jobs
+	running int            // # jobs being processed
+	limit   int            // max running; 0 means no limit
+}
+
 type JobQueue struct {
-	sync.Mutex                // protects nworker and nzombie
-	nworker    int            // # go routines running
-	nzombie    int            // # those dying
-	backlog    chan *Item     // send jobs through this channel
-	waitGroup  sync.WaitGroup // sync for group exit
+	sync.Mutex                  // protects everything below
+	cond       *sync.Cond       // signal new job, zombie or close
+	nworker    int              // # go routines running
+	nzombie    int              // # those dying
+	closed     bool             // no more jobs
+	level      [NPRIORITY]level // jobs waiting
+	waitGroup  sync.WaitGroup   // sync for group exit
 }
 
 func New(nworker int) *JobQueue {
-	jq := &JobQueue{backlog: make(chan *Item, 100)}
+	jq := &JobQueue{}
+	jq.cond = sync.NewCond(&jq.Mutex)
+	for i := range jq.level {
+		jq.level[i].client = make(map[string]*clientQueue)
+	}
 	jq.SetNWorker(nworker)
 	return jq
 }
 
+// Run the jobs still waiting, then stop all workers
 func (jq *JobQueue) Destroy() {
-	close(jq.backlog)
+	jq.Lock()
+	jq.closed = true
+	jq.cond.Broadcast()
+	jq.Unlock()
 	jq.waitGroup.Wait()
 }
 
 func (jq *JobQueue) NWorker() int {
-	return jq.nworker
+	jq.Lock()
+	defer jq.Unlock()
+	return jq.nworker - jq.nzombie
+}
+
+// Return # jobs waiting at priority pri
+func (jq *JobQueue) Len(pri int) int {
+	jq.Lock()
+	defer jq.Unlock()
+	return jq.level[pri].count
+}
+
+// Return # jobs being processed at priority pri
+func (jq *JobQueue) Running(pri int) int {
+	jq.Lock()
+	defer jq.Unlock()
+	return jq.level[pri].running
+}
+
+// Allow at most n workers to process jobs of priority pri at any time;
+// n == 0 removes the limit. This keeps background work from taking
+// every worker when a burst of foreground jobs arrives.
+func (jq *JobQueue) SetLimit(pri int, n int) {
+	if n < 0 {
+		return
+	}
+	jq.Lock()
+	jq.level[pri].limit = n
+	jq.cond.Broadcast()
+	jq.Unlock()
 }
 
 func (jq *JobQueue) SetNWorker(n int) {
@@ -67,6 +155,8 @@ func (jq *JobQueue) SetNWorker(n int) {
 			jq.nzombie++
 		}
 	}
+	// wake up idle workers so that zombies can exit
+	jq.cond.Broadcast()
 	jq.Unlock()
 
 	for i := 0; i < addition; i++ {
@@ -75,27 +165,105 @@ func (jq *JobQueue) SetNWorker(n int) {
 	}
 }
 
+// Take the next job. Caller must hold jq.
+func (jq *JobQueue) get() *Item {
+	for pri := range jq.level {
+		lv := &jq.level[pri]
+		if lv.count == 0 || (lv.limit > 0 && lv.running >= lv.limit) {
+			continue
+		}
+		if lv.next >= len(lv.ring) {
+			lv.next = 0
+		}
+		cq := lv.ring[lv.next]
+		item := cq.item[0]
+		cq.item[0] = nil
+		cq.item = cq.item[1:]
+		lv.count--
+		lv.running++
+		if len(cq.item) == 0 {
+			// client has no more jobs; the next client moves into its turn
+			lv.ring = append(lv.ring[:lv.next], lv.ring[lv.next+1:]...)
+			delete(lv.client, cq.name)
+		} else {
+			lv.next++
+		}
+		return item
+	}
+	return nil
+}
+
 func (jq *JobQueue) run() {
-	for item := range jq.backlog {
-		item.processItem(item.idx)
+	jq.Lock()
+	for {
 		if jq.nzombie > 0 {
-			exit := false
-			jq.Lock()
-			if jq.nzombie > 0 {
-				jq.nzombie--
-				exit = true
-			}
-			jq.Unlock()
-
-			if exit {
+			jq.nzombie--
+			jq.nworker--
+			// pass on any wakeup meant for a live worker
+			jq.cond.Signal()
+			break
+		}
+		item := jq.get()
+		if item == nil {
+			if jq.closed && jq.empty() {
 				break
 			}
+			jq.cond.Wait()
+			continue
+		}
+
+		jq.Unlock()
+		item.processItem(item.idx)
+		jq.Lock()
+
+		jq.level[item.pri].running--
+		if jq.level[item.pri].limit > 0 {
+			// a worker held back by the limit may go now
+			jq.cond.Signal()
 		}
 	}
+	jq.Unlock()
 	jq.waitGroup.Done()
 }
 
-func (jq *JobQueue) Add(processItem func(idx int), idx int) {
-	item := &Item{idx, processItem}
-	jq.backlog <- item
+// Are there no jobs waiting? Caller must hold jq.
+func (jq *JobQueue) empty() bool {
+	for pri := range jq.level {
+		if jq.level[pri].count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add a job of NORMAL priority from an anonymous client
+func (jq *JobQueue) Add(processItem func(idx int), idx int) error {
+	return jq.AddPriority(NORMAL, "", processItem, idx)
+}
+
+// Add a job of priority pri submitted by client. Fails with ErrClosed
+// after Destroy.
+func (jq *JobQueue) AddPriority(pri int, client string, processItem func(idx int), idx int) error {
+	if pri < 0 || pri >= NPRIORITY {
+		pri = NORMAL
+	}
+	item := &Item{pri, idx, processItem}
+
+	jq.Lock()
+	if jq.closed {
+		jq.Unlock()
+		return ErrClosed
+	}
+	lv := &jq.level[pri]
+	cq := lv.client[client]
+	if cq == nil {
+		cq = &clientQueue{name: client}
+		lv.client[client] = cq
+		lv.ring = append(lv.ring, cq)
+	}
+	cq.item = append(cq.item, item)
+	lv.count++
+	jq.cond.Signal()
+	jq.Unlock()
+	return nil
 }
@@ -0,0 +1,128 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package jobqueue
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hold the only worker of jq busy until the returned func is called
+func block(t *testing.T, jq *JobQueue) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	if err := jq.AddPriority(HIGH, "block", func(int) {
+		close(started)
+		<-release
+	}, 0); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	return func() { close(release) }
+}
+
+// Add jobs that append their name to the order they ran in
+type recorder struct {
+	sync.Mutex
+	ran []string
+}
+
+func (r *recorder) add(t *testing.T, jq *JobQueue, pri int, client, name string) {
+	err := jq.AddPriority(pri, client, func(int) {
+		r.Lock()
+		r.ran = append(r.ran, name)
+		r.Unlock()
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *recorder) String() string {
+	r.Lock()
+	defer r.Unlock()
+	return strings.Join(r.ran, " ")
+}
+
+func TestPriority(t *testing.T) {
+	jq := New(1)
+	release := block(t, jq)
+	var r recorder
+	r.add(t, jq, LOW, "", "low")
+	r.add(t, jq, NORMAL, "", "normal")
+	r.add(t, jq, HIGH, "", "high")
+	release()
+	jq.Destroy()
+
+	if got, want := r.String(), "high normal low"; got != want {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	jq := New(1)
+	release := block(t, jq)
+	var r recorder
+	for _, name := range []string{"a1", "a2", "a3"} {
+		r.add(t, jq, NORMAL, "a", name)
+	}
+	for _, name := range []string{"b1", "b2"} {
+		r.add(t, jq, NORMAL, "b", name)
+	}
+	release()
+	jq.Destroy()
+
+	if got, want := r.String(), "a1 b1 a2 b2 a3"; got != want {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	jq := New(3)
+	jq.SetLimit(LOW, 1)
+	release := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		jq.AddPriority(LOW, "", func(int) { <-release }, 0)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := jq.Running(LOW); n != 1 {
+		t.Errorf("%d low jobs running, want 1", n)
+	}
+	if n := jq.Len(LOW); n != 2 {
+		t.Errorf("%d low jobs waiting, want 2", n)
+	}
+	close(release)
+	jq.Destroy()
+}
+
+func TestClosed(t *testing.T) {
+	jq := New(2)
+	jq.Destroy()
+	if err := jq.Add(func(int) {}, 0); err != ErrClosed {
+		t.Errorf("Add after Destroy returned %v, want ErrClosed", err)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, name := range []string{"high", "NORMAL", "Low"} {
+		pri, err := ParsePriority(name)
+		if err != nil || !strings.EqualFold(PriorityName(pri), name) {
+			t.Errorf("ParsePriority(%q) = %d, %v", name, pri, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority(\"urgent\") did not fail")
+	}
+}
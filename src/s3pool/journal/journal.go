@@ -0,0 +1,167 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Journal is a file of JSON records, one per line, that survives a
+// crash: a record is synced to disk before Add or Done returns. Add
+// appends an entry of work to do and Done a record that marks it done.
+// Open replays the file and rewrites it with only the entries not done.
+
+type Entry struct {
+	Seq    int64
+	Bucket string `json:",omitempty"`
+	Key    string `json:",omitempty"`
+	Path   string `json:",omitempty"` // file of the entry
+	Time   int64  `json:",omitempty"` // unix time the entry was added
+	Done   bool   `json:",omitempty"`
+}
+
+type Journal struct {
+	mux  sync.Mutex
+	path string
+	f    *os.File
+	seq  int64 // of the last entry
+}
+
+// Open the journal at path, creating it if needed. Returns the entries
+// not done in the order they were added.
+func Open(path string) (*Journal, []Entry, error) {
+	todo, seq, err := replay(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// rewrite the journal with the entries not done
+	tmppath := path + ".tmp"
+	f, err := os.OpenFile(tmppath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range todo {
+		if err = write(f, &e); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	if err = f.Sync(); err == nil {
+		err = os.Rename(tmppath, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &Journal{path: path, f: f, seq: seq}, todo, nil
+}
+
+func replay(path string) (todo []Entry, seq int64, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	entries := make(map[int64]Entry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last record may have been cut short by a crash
+			log.Printf("journal: skip bad record in %s -- %v\n", path, err)
+			continue
+		}
+		if e.Seq > seq {
+			seq = e.Seq
+		}
+		if e.Done {
+			delete(entries, e.Seq)
+		} else {
+			entries[e.Seq] = e
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("Cannot read %s -- %v", path, err)
+	}
+
+	for _, e := range entries {
+		todo = append(todo, e)
+	}
+	sort.Slice(todo, func(i, j int) bool { return todo[i].Seq < todo[j].Seq })
+	return todo, seq, nil
+}
+
+func write(f *os.File, e *Entry) error {
+	byt, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(byt, '\n'))
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *Journal) append(e *Entry) error {
+	if err := write(j.f, e); err != nil {
+		return fmt.Errorf("Cannot write %s -- %v", j.path, err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("Cannot sync %s -- %v", j.path, err)
+	}
+	return nil
+}
+
+// Add an entry for the file at path of bucket:key. The file should be
+// synced to disk already.
+func (j *Journal) Add(bucket, key, path string) (Entry, error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	e := Entry{Seq: j.seq + 1, Bucket: bucket, Key: key, Path: path, Time: time.Now().Unix()}
+	if err := j.append(&e); err != nil {
+		return Entry{}, err
+	}
+	j.seq = e.Seq
+	return e, nil
+}
+
+// Mark the entry seq done
+func (j *Journal) Done(seq int64) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.append(&Entry{Seq: seq, Done: true})
+}
@@ -0,0 +1,95 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, todo, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todo) != 0 {
+		t.Fatalf("new journal has %d entries", len(todo))
+	}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if _, err := j.Add("bkt", key, "/tmp/"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Done(2); err != nil {
+		t.Fatal(err)
+	}
+	// a record cut short by a crash
+	j.f.Write([]byte(`{"Seq":4,"Bucket":"bk`))
+	j.f.Close()
+
+	j, todo, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.f.Close()
+	if len(todo) != 2 || todo[0].Key != "k1" || todo[1].Key != "k3" {
+		t.Fatalf("replay returned %+v, want k1 and k3", todo)
+	}
+	if todo[1].Seq != 3 || todo[1].Bucket != "bkt" || todo[1].Path != "/tmp/k3" {
+		t.Errorf("bad entry %+v", todo[1])
+	}
+
+	// the journal was rewritten with the entries not done
+	byt, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(byt, []byte("\n")); n != 2 {
+		t.Errorf("journal has %d records after Open, want 2", n)
+	}
+
+	// sequence numbers go on from the last one seen
+	e, err := j.Add("bkt", "k4", "/tmp/k4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != 4 {
+		t.Errorf("Add after replay got seq %d, want 4", e.Seq)
+	}
+}
+
+func TestReplayAllDone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, _, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := j.Add("bkt", "key", "/tmp/key")
+	j.Done(e.Seq)
+	j.f.Close()
+
+	j, todo, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.f.Close()
+	if len(todo) != 0 {
+		t.Errorf("replay returned %+v, want nothing", todo)
+	}
+	if j.seq != e.Seq {
+		t.Errorf("seq is %d after replay, want %d", j.seq, e.Seq)
+	}
+}
@@ -3,17 +3,18 @@ package lander
 import (
 	//	"errors"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"s3pool/conf"
+	"s3pool/proc"
 )
 
 type Csvspec struct {
@@ -43,7 +44,12 @@ func Init(devices []string, rows_per_group int) {
 	g_rows_per_group = rows_per_group
 }
 
-func Xrgdiv(bucket string, key string, schemafn string, filespecjs string) (string, error) {
+// return the device directories given to Init
+func Devices() []string {
+	return g_devices
+}
+
+func Xrgdiv(ctx context.Context, bucket string, key string, schemafn string, filespecjs string) (string, error) {
 	var fspec Filespec
 	var args []string
 	csvp := mapToCsvRelativePath(bucket, key)
@@ -77,13 +83,18 @@ func Xrgdiv(bucket string, key string, schemafn string, filespecjs string) (stri
 
 	args = append(args, csvp)
 
-	cmd := exec.Command("xrgdiv", args...)
+	ctx, cancel := proc.WithTimeout(ctx, conf.XrgdivTimeout)
+	defer cancel()
+	cmd := proc.Command(ctx, "xrgdiv", args...)
 
 	var outbuf, errbuf bytes.Buffer
 	cmd.Stdout = &outbuf
 	cmd.Stderr = &errbuf
 
 	if err := cmd.Run(); err != nil {
+		if terr := proc.Err(ctx, "xrgdiv"); terr != nil {
+			return "", terr
+		}
 		errstr := string(errbuf.Bytes())
 		return "", fmt.Errorf("xrgdiv failed -- %s", errstr)
 	}
@@ -113,8 +124,9 @@ func RemoveXrgFile(zmppath string) (err error) {
 		json.Unmarshal(bytes, &flist)
 
 		for i := 0; i < len(flist); i++ {
+			// a segment may be missing already; fsck removes such outputs
 			err := os.Remove(flist[i])
-			if err != nil {
+			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
 		}
@@ -143,6 +155,34 @@ func RemoveXrgFile(zmppath string) (err error) {
 	return nil
 }
 
+// return all files that make up the xrg output of zmppath: the .zmp,
+// .list and .schema files plus the segment files named in .list.
+// Only files that exist are returned.
+func XrgFiles(zmppath string) (files []string) {
+	stem := zmppath[:len(zmppath)-4]
+
+	if fileReadable(stem + ".list") {
+		var flist []string
+		bytes, err := ioutil.ReadFile(stem + ".list")
+		if err == nil {
+			json.Unmarshal(bytes, &flist)
+		}
+		for i := 0; i < len(flist); i++ {
+			if fileReadable(flist[i]) {
+				files = append(files, flist[i])
+			}
+		}
+		files = append(files, stem+".list")
+	}
+
+	for _, p := range []string{stem + ".schema", zmppath} {
+		if fileReadable(p) {
+			files = append(files, p)
+		}
+	}
+	return
+}
+
 func Stem(base string) string {
 
 	var stem string
@@ -189,8 +229,8 @@ func fileReadable(path string) bool {
 }
 
 func mapToCsvRelativePath(bucket, key string) (path string) {
-	if conf.DfsMode == conf.DFS_LOCAL {
-		path = fmt.Sprintf("/%s/%s", bucket, key)
+	if conf.BucketDfsMode(bucket) == conf.DFS_LOCAL {
+		path = conf.SourcePath(bucket, key)
 	} else {
 		path = fmt.Sprintf("data/%s/%s", bucket, key)
 	} 
@@ -13,25 +13,24 @@
 package local
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/version"
 )
 
-var g_src_prefix string
-
 func Init(src_prefix string) {
-	g_src_prefix = src_prefix
+	conf.SrcPrefix = src_prefix
 }
 
 // Invoke aws s3api to retrieve a file. Form:
 //
 //	aws s3api get-object --bucket BUCKET --key KEY --if-none-match ETAG tmppath
-func GetObject(bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
+func GetObject(ctx context.Context, bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
 	if conf.Verbose(1) {
 		log.Println("local GetObject", bucket, key)
 	}
@@ -47,7 +46,7 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	catetag := cat.Find(bucket, key)
 
 	// Get destination path
-	dfspath := filepath.Join(g_src_prefix, bucket, key)
+	dfspath := conf.SourcePath(bucket, key)
 
 	// If etag did not change, don't go fetch it
 	if etag != "" && etag == catetag && !force {
@@ -75,8 +74,12 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	os.Remove(tmppath) // avoid File Exists error from hdfs
 	defer os.Remove(tmppath)
 
-	// Remote checksum always equals to zero
-	newetag := "0"
+	// The etag is the inode, size and mtime of the source file
+	fi, err := os.Stat(dfspath)
+	if err != nil {
+		return
+	}
+	newetag := version.Local(fi)
 	if etag == newetag {
 		err = nil
 		if conf.Verbose(1) {
@@ -93,7 +96,7 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 		return
 	}
 
-	etag_content := "0" + " " + dfspath
+	etag_content := newetag + " " + dfspath
 	// Save the meta info
 	ioutil.WriteFile(tmppath, []byte(etag_content), 0644)
 	if err = moveFile(tmppath, metapath); err != nil {
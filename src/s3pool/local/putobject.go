@@ -0,0 +1,106 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/strlock"
+	"s3pool/version"
+)
+
+// Copy the file fname to the source path of bucket:key. The copy is
+// written to a temporary file in the same directory and renamed over
+// the source file, so that readers never see a partial file.
+func PutObject(ctx context.Context, bucket, key, fname string) error {
+	if conf.Verbose(1) {
+		log.Println("local put", bucket, key, fname)
+	}
+
+	if len(fname) > 0 && fname[0] != '/' {
+		return fmt.Errorf("Filename parameter must be an absolute path")
+	}
+
+	// lock to serialize on (bucket,key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	dst := conf.SourcePath(bucket, key)
+	if err = copyFile(fname, dst); err != nil {
+		return err
+	}
+
+	// the etag is the inode, size and mtime of the copy, as GetObject
+	// records it. The lander outputs of the old source go, and the
+	// meta file is written so that the next PULL converts the copy.
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	etag := version.Local(fi)
+	if err = cache.Keep(bucket, key, dst, []byte(etag+" "+dst)); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
+	}
+
+	// reflect the new file in our catalog
+	cat.Upsert(bucket, key, etag)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir := filepath.Dir(dst)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Cannot mkdir %s -- %v", dir, err)
+	}
+	out, err := ioutil.TempFile(dir, "."+filepath.Base(dst)+conf.LOCALTEMP)
+	if err != nil {
+		return fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	tmppath := out.Name()
+	defer os.Remove(tmppath)
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmppath, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot copy to %s -- %v", dst, err)
+	}
+	if err = os.Rename(tmppath, dst); err != nil {
+		return fmt.Errorf("Cannot mv file -- %v", err)
+	}
+	return nil
+}
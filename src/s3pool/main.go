@@ -20,8 +20,12 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"s3pool/cache"
 	"s3pool/conf"
 	"s3pool/gcs"
+	"s3pool/jobqueue"
 	"s3pool/lander"
 	"s3pool/local"
 	"s3pool/mon"
@@ -30,6 +34,7 @@ import (
 	"s3pool/s3meta"
 	"s3pool/tcp_server"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -138,21 +143,55 @@ func serve(c *tcp_server.Client, request string) {
 		cmdargs = args[1:]
 	}
 
+	// PULL may carry a priority qualifier, e.g. PULL/HIGH or PULL/LOW
+	pri := jobqueue.NORMAL
+	if s := strings.SplitN(cmd, "/", 2); len(s) == 2 && s[0] == "PULL" {
+		cmd = s[0]
+		if pri, err = jobqueue.ParsePriority(s[1]); err != nil {
+			return
+		}
+	}
+
 	// dispatch cmd
 	switch cmd {
 	case "PULL":
-		reply, err = op.Pull(cmdargs)
+		reply, err = op.Pull(cmdargs, pri, c.RemoteHost())
 	case "GLOB":
 		reply, err = op.Glob(cmdargs)
 		if err == nil {
 			conf.NotifyBucketmon(cmdargs[0])
 		}
+	case "PREFETCH":
+		reply, err = op.Prefetch(cmdargs, c.RemoteHost())
+		if err == nil {
+			conf.NotifyBucketmon(cmdargs[0])
+		}
 	case "REFRESH":
 		reply, err = op.Refresh(cmdargs)
 	case "PUSH":
 		reply, err = op.Push(cmdargs)
 	case "SET":
 		reply, err = op.Set(cmdargs)
+	case "GET":
+		reply, err = op.Get(cmdargs)
+	case "SHOW":
+		reply, err = op.Show(cmdargs)
+	case "SETB":
+		reply, err = op.SetB(cmdargs)
+	case "EVICT":
+		reply, err = op.Evict(cmdargs)
+	case "PIN":
+		reply, err = op.Pin(cmdargs)
+	case "UNPIN":
+		reply, err = op.Unpin(cmdargs)
+	case "SHUTDOWN":
+		reply, err = op.Shutdown(cmdargs)
+	case "RELOAD":
+		reply, err = op.Reload(cmdargs)
+	case "FSCK":
+		reply, err = op.Fsck(cmdargs)
+	case "LOCKS":
+		reply, err = op.Locks(cmdargs)
 	case "STATUS":
 		reply, err = op.Status(cmdargs)
 	default:
@@ -193,6 +232,92 @@ type progArgs struct {
 	local           *bool
 	rows_per_group  *int
 	local_prefix    *string
+	hwm             *int
+	lwm             *int
+	evictPolicy     *string
+	pinLimit        *string
+	quotas          arrayFlags
+	config          *string
+	cfg             conf.Config     // settings of the config file
+	flagged         map[string]bool // settings of cfg given by flags
+}
+
+// Flags of the settings of the config file. The dfs setting picks one
+// of the flags -s3, -gcs, -hdfs, -hdfs2x and -local.
+var configFlag = map[string]string{
+	"home":             "D",
+	"port":             "p",
+	"pidfile":          "pidfile",
+	"no_daemon":        "n",
+	"pull_concurrency": "c",
+	"devices":          "d",
+	"src_prefix":       "src_prefix",
+	"rows_per_group":   "N",
+	"hwm":              "hwm",
+	"lwm":              "lwm",
+	"evict_policy":     "evict_policy",
+	"pin_limit":        "pin_limit",
+	"quota":            "quota",
+}
+
+// Read the config file and use its settings for the flags not given on
+// the command line
+func (p *progArgs) loadConfig() (err error) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	path := *p.config
+	if path == "" {
+		if *p.dir == "" {
+			return nil
+		}
+		path = filepath.Join(*p.dir, conf.CONFIGFILE)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return err
+	}
+	// RELOAD reads the default file even if it is created later
+	conf.ConfigFile = path
+	if _, err = os.Stat(path); os.IsNotExist(err) && *p.config == "" {
+		return nil
+	}
+
+	cfg, err := conf.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err = op.CheckConfig(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	p.cfg = cfg
+	p.flagged = make(map[string]bool)
+	for name, values := range cfg {
+		fname := configFlag[name]
+		if name == "dfs" {
+			mode, _ := conf.ParseBackend(values[0])
+			fname = conf.BackendName(mode)
+			if explicit["s3"] || explicit["gcs"] || explicit["hdfs"] || explicit["hdfs2x"] || explicit["local"] {
+				explicit[fname] = true
+			}
+			values = []string{"true"}
+		}
+		if fname == "" {
+			continue
+		}
+		p.flagged[name] = true
+		if explicit[fname] {
+			continue
+		}
+		for _, v := range values {
+			if err = flag.Set(fname, v); err != nil {
+				return fmt.Errorf("%s: %s -- %v", path, name, err)
+			}
+		}
+	}
+	return nil
 }
 
 func parseArgs() (p progArgs, err error) {
@@ -210,6 +335,12 @@ func parseArgs() (p progArgs, err error) {
 	p.local = flag.Bool("local", false, "run in local mode")
 	p.local_prefix = flag.String("src_prefix", "/", "source prefix path for local")
 	p.rows_per_group = flag.Int("N", 0, "number of rows per group")
+	p.hwm = flag.Int("hwm", conf.HWM, "start eviction when a device is this % full")
+	p.lwm = flag.Int("lwm", conf.LWM, "evict until a device is this % full")
+	p.evictPolicy = flag.String("evict_policy", conf.EvictPolicy, "eviction policy: lru, lfu, size or arc")
+	flag.Var(&p.quotas, "quota", "bucket=size, limit bytes cached for bucket")
+	p.pinLimit = flag.String("pin_limit", "0", "max bytes of pinned objects, 0 for no limit")
+	p.config = flag.String("config", "", "config file (default "+conf.CONFIGFILE+" in the home directory)")
 
 	flag.Parse()
 
@@ -218,6 +349,10 @@ func parseArgs() (p progArgs, err error) {
 		return
 	}
 
+	if err = p.loadConfig(); err != nil {
+		return
+	}
+
 	if !(0 < *p.port && *p.port <= 65535) {
 		err = errors.New("Missing or invalid port number.")
 		return
@@ -232,6 +367,26 @@ func parseArgs() (p progArgs, err error) {
 		return
 	}
 
+	if !(0 < *p.lwm && *p.lwm < *p.hwm && *p.hwm < 100) {
+		err = errors.New("Invalid water marks. Expects 0 < lwm < hwm < 100.")
+		return
+	}
+
+	if _, err = conf.ParseSize(*p.pinLimit); err != nil {
+		return
+	}
+
+	for _, q := range p.quotas {
+		nv := strings.SplitN(q, "=", 2)
+		if len(nv) != 2 || nv[0] == "" {
+			err = errors.New("Invalid quota. Expects bucket=size.")
+			return
+		}
+		if _, err = conf.ParseSize(nv[1]); err != nil {
+			return
+		}
+	}
+
 	if !*p.s3 && !*p.hdfs && !*p.hdfs2x && !*p.local && !*p.gcs {
 		err = errors.New("Missing or invalid dfs. Either -s3, -hdfs, -hdfs2x, -gcs or -local.")
 		return
@@ -299,6 +454,12 @@ func main() {
 
 	// save some conf
 	conf.PullConcurrency = *p.pullConcurrency
+	conf.HWM = *p.hwm
+	conf.LWM = *p.lwm
+	conf.PinLimit, _ = conf.ParseSize(*p.pinLimit)
+	if err := cache.SetPolicy(*p.evictPolicy); err != nil {
+		exit(err.Error())
+	}
 	//conf.Master = *p.master
 	//conf.Standby = *p.standby
 
@@ -326,6 +487,10 @@ func main() {
 			if argv[i] == "-D" {
 				argv[i+1] = "."
 			}
+			// likewise a relative path of the config file
+			if argv[i] == "-config" {
+				argv[i+1] = conf.ConfigFile
+			}
 		}
 		mon.Daemonize(*p.daemonPrep, argv)
 	}
@@ -336,14 +501,17 @@ func main() {
 	// start log
 	mon.Logmon()
 
-	// start the disk space monitor
-	mon.Diskmon()
-
-	// start pidfile monitor
-	mon.Pidmon()
-
-	// start Bucket monitor
-	conf.BucketmonChannel = mon.Bucketmon()
+	// load the per-bucket settings; the quotas given on the command
+	// line are among them
+	if err = conf.LoadBuckets(); err != nil {
+		exit(err.Error())
+	}
+	for _, q := range p.quotas {
+		nv := strings.SplitN(q, "=", 2)
+		if _, _, err = conf.SetBucket(nv[0], "quota", nv[1]); err != nil {
+			exit(err.Error())
+		}
+	}
 
 	// conf.DfsMode
 	if *p.s3 {
@@ -377,15 +545,87 @@ func main() {
 
 	s3meta.Initialize(29)
 
+	// load the cache index
+	cache.Init()
+
+	// apply the quotas and pins of the per-bucket settings
+	op.InitBuckets()
+
+	// replay the write-back journal and start uploading
+	if err = op.InitWriteback(); err != nil {
+		exit(err.Error())
+	}
+
+	// finish the multipart uploads cut short by the last stop
+	op.InitUploads()
+
+	// start the disk space monitor; it needs conf.DfsMode and the lander devices
+	mon.Diskmon()
+
+	// start pidfile monitor
+	mon.Pidmon()
+
+	// start Bucket monitor
+	conf.BucketmonChannel, conf.BucketmonWaitChannel = mon.Bucketmon()
+
+	// apply the rest of the config file, and reload it on SIGHUP
+	if err = op.InitConfig(p.cfg, p.flagged); err != nil {
+		exit(err.Error())
+	}
+	mon.Hupmon()
+
 	// start server
 	server, err := tcp_server.New(fmt.Sprintf("0.0.0.0:%d", *p.port), serve)
 	if err != nil {
 		log.Fatal("Listen() failed - %v", err)
 	}
 
-	// keep serving
-	err = server.Loop()
-	if err != nil {
-		log.Fatal("Loop() failed - %v", err)
+	// keep serving until SIGTERM, SIGINT or SHUTDOWN
+	go func() {
+		err := server.Loop()
+		if err != nil {
+			log.Fatal("Loop() failed - %v", err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	var secs int
+	select {
+	case sig := <-sigs:
+		log.Println("Received", sig)
+		secs = conf.ShutdownTimeout
+	case secs = <-conf.ShutdownChannel:
+	}
+	shutdown(server, secs)
+}
+
+type drainer interface {
+	Close() error
+	Wait(timeout time.Duration) bool
+}
+
+// Stop accepting requests, give the requests in progress and the jobs
+// queued up to secs seconds to finish, cancel those left, and exit
+func shutdown(server drainer, secs int) {
+	log.Printf("Shutting down; draining for up to %d seconds\n", secs)
+	deadline := time.Now().Add(time.Duration(secs) * time.Second)
+
+	server.Close()
+	op.StopBackground()
+	if !server.Wait(time.Until(deadline)) {
+		log.Println("Requests still running at the deadline")
+	}
+	if !op.Drain(time.Until(deadline)) {
+		log.Println("Jobs still running at the deadline were canceled")
+		// let the canceled requests reply
+		server.Wait(5 * time.Second)
+	}
+
+	if err := cache.Checkpoint(); err != nil {
+		log.Println("cannot checkpoint cache index --", err)
 	}
+	pidfile.Remove()
+	log.Println("s3pool exiting ...")
+	os.Exit(0)
 }
@@ -17,61 +17,122 @@ import (
 	"math/rand"
 	"s3pool/conf"
 	"s3pool/op"
+	"s3pool/retry"
 	"time"
 )
 
-func Bucketmon() chan<- string {
+// Bucketmon refreshes each bucket it was notified of every
+// conf.BucketRefreshInterval minutes, give or take JITTER so that
+// buckets added together do not refresh together. Refreshes run in
+// their own go routines, at most conf.RefreshConcurrency at a time;
+// the loop itself never blocks on one. A bucket that a request waits
+// on is refreshed at once, even if it is scheduled for later or backing
+// off after a failure.
+
+// fraction of the interval by which a refresh may move
+const JITTER = 0.1
+
+type bucketState struct {
+	next     time.Time // when to refresh next
+	running  bool      // a refresh is in progress
+	failures int       // consecutive failed refreshes
+}
+
+type refreshResult struct {
+	bucket string
+	err    error
+}
+
+// Return the time of the next refresh of bucket after a success
+func nextRefresh(bucket string) time.Time {
+	d := time.Duration(conf.BucketRefreshInterval(bucket)) * time.Minute
+	jitter := time.Duration((rand.Float64()*2 - 1) * JITTER * float64(d))
+	return time.Now().Add(d + jitter)
+}
+
+// Start bucketmon. Returns the channel of the buckets to refresh, and
+// that of the buckets to refresh at once.
+func Bucketmon() (chan<- string, chan<- string) {
 	bmnotify := make(chan string, 10)
+	bmwait := make(chan string, 10)
 
 	go func() {
 		tick := time.Tick(time.Second)
-		bktmap := make(map[string](int))
+		done := make(chan refreshResult)
+		bktmap := make(map[string]*bucketState)
+		running := 0
+
 		for {
 			select {
 			case bkt := <-bmnotify:
 				if bkt == "" {
 					// this is a special message to notify that
-					// conf.RefreshInterval has changed
+					// the refresh intervals have changed
 
-					// if expiration time of any bucket is beyond RefreshInterval,
-					// set it to a random value between 0 and RefreshInterval
-					for bkt := range bktmap {
-						if bktmap[bkt] > conf.RefreshInterval*60 {
-							bktmap[bkt] = rand.Intn(conf.RefreshInterval * 60)
+					// if the next refresh of any bucket is beyond its interval,
+					// move it to a random time within the interval
+					for bkt, st := range bktmap {
+						d := time.Duration(conf.BucketRefreshInterval(bkt)) * time.Minute
+						if time.Until(st.next) > d {
+							st.next = time.Now().Add(time.Duration(rand.Int63n(int64(d) + 1)))
 						}
 					}
 
 					continue
 				}
 
-				// if not in bktmap, add it with an expiration of 0 ... we will
-				// almost immediately refresh it.
+				// if not in bktmap, add it to be refreshed at once
 				if _, ok := bktmap[bkt]; !ok {
-					bktmap[bkt] = 0
+					bktmap[bkt] = &bucketState{next: time.Now()}
 				}
+
+			case bkt := <-bmwait:
+				// a running refresh will do; otherwise refresh at once
+				if st, ok := bktmap[bkt]; !ok {
+					bktmap[bkt] = &bucketState{next: time.Now()}
+				} else if !st.running {
+					st.next = time.Now()
+				}
+
+			case r := <-done:
+				running--
+				st := bktmap[r.bucket]
+				st.running = false
+				if r.err == nil {
+					log.Println("BUCKETMON fin", r.bucket)
+					st.failures = 0
+					st.next = nextRefresh(r.bucket)
+					continue
+				}
+				st.failures++
+				if retry.Retryable(r.err) && st.failures < conf.RetryAttempts {
+					delay := retry.Backoff(st.failures)
+					log.Printf("WARNING: autorefresh %s failed, retry in %v: %v\n", r.bucket, delay.Round(time.Second), r.err)
+					st.next = time.Now().Add(delay)
+					continue
+				}
+				log.Printf("WARNING: autorefresh %s failed: %v\n", r.bucket, r.err)
+				delete(bktmap, r.bucket)
+
 			case <-tick:
-				//log.Println("tick")
-				for bkt := range bktmap {
-					bktmap[bkt]--
-					//log.Println("bucket", bkt, bktmap[bkt])
-					if bktmap[bkt] <= 0 {
-						// note: maybe we should run the refresh in a
-						// separate go routine?
-						log.Println("BUCKETMON refresh", bkt)
-						_, err := op.Refresh([]string{bkt})
-						log.Println("BUCKETMON fin", bkt)
-						if err != nil {
-							log.Printf("WARNING: autorefresh %s failed: %v\n", bkt, err)
-							delete(bktmap, bkt)
-							continue
-						}
-						bktmap[bkt] = conf.RefreshInterval * 60
+				now := time.Now()
+				for bkt, st := range bktmap {
+					if running >= conf.RefreshConcurrency {
+						break
+					}
+					if st.running || now.Before(st.next) {
+						continue
 					}
+					log.Println("BUCKETMON refresh", bkt)
+					st.running = true
+					running++
+					go func(bkt string) {
+						done <- refreshResult{bkt, op.RefreshBackground(bkt)}
+					}(bkt)
 				}
-				//log.Println("tick done")
 			}
 		}
 	}()
 
-	return bmnotify
+	return bmnotify, bmwait
 }
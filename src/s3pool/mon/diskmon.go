@@ -14,89 +14,74 @@ package mon
 
 import (
 	"log"
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+	"s3pool/cache"
+	"s3pool/conf"
 	"syscall"
 	"time"
 )
 
-// Only count utilization under data directory
-func diskUsageOfSubdirs() int64 {
-	cmd := exec.Command("du", "-s", "data", "-B", "1048576")
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	fields := strings.Fields(string(out))
-	used, err := strconv.Atoi(fields[0])
-	if err != nil {
-		log.Fatal(err)
-	}
-	return int64(used) * 1048576
-}
+// Each device (data/ in homedir and each lander device directory) is
+// kept between conf.LWM and conf.HWM on its own. The bytes used by the
+// cache on a device come from the cache index; no scan of the disk is
+// needed.
 
 // Instead of the disk size, we consider total available disk as what
 // we currently used + what is available.
-func diskUsage() (used, total int64, pct int) {
+func diskUsage(dev int) (used, total int64, pct int, err error) {
 	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(".", &fs)
-	if err != nil {
-		log.Fatal(err)
+	if err = syscall.Statfs(cache.Devices()[dev], &fs); err != nil {
+		return
 	}
 	free := int64(fs.Bfree) * int64(fs.Bsize)
-	used = diskUsageOfSubdirs()
+	used = cache.Usage(dev)
 	total = free + used
-	pct = int(used * 100 / total)
-	return
-}
-
-func deleteSomeFiles() {
-	// use *find* command to get 10 least-recently-used files under the data/ directory
-	script := `find ./data/ -type f -printf "%AY%Am%Ad %AT %p\n" | sort 2> /dev/null | head -10`
-	cmd := exec.Command("bash", "-c", script)
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	lines := strings.Split(string(out), "\n")
-
-	// delete those files
-	for _, line := range lines {
-		for ii, vv := range strings.Fields(line) {
-			if ii >= 2 {
-				err = os.Remove(vv)
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-		}
+	if total > 0 {
+		pct = int(used * 100 / total)
 	}
+	return
 }
 
-const HWM = 90
-const LWM = 75
-
 func Diskmon() {
-	const REFRESHINTERVAL = 5 // minutes
+	const REFRESHINTERVAL = 1    // minutes
+	const CHECKPOINTINTERVAL = 5 // minutes
 
 	go func() {
+		lastCheckpoint := time.Now()
 		for {
-			used, total, pct := diskUsage()
+			// keep noisy buckets within their quota first
+			if count, freed := cache.EnforceQuotas(); count > 0 {
+				log.Printf("diskmon: evicted %d objects, %d bytes from buckets over quota\n", count, freed)
+			}
 
-			if pct < HWM {
-				log.Printf("diskmon: %d out of %d bytes or %d%% -- skip cleanup\n", used, total, pct)
-				time.Sleep(REFRESHINTERVAL * time.Minute)
-				continue
+			for dev, path := range cache.Devices() {
+				used, total, pct, err := diskUsage(dev)
+				if err != nil {
+					log.Printf("diskmon: %s -- %v\n", path, err)
+					continue
+				}
+
+				if pct < conf.HWM {
+					if conf.Verbose(2) {
+						log.Printf("diskmon: %s %d out of %d bytes or %d%% -- skip cleanup\n", path, used, total, pct)
+					}
+					continue
+				}
+
+				log.Printf("diskmon: %s %d out of %d bytes or %d%% -- commencing cleanup\n", path, used, total, pct)
+				count, freed := cache.Evict(dev, used-total*int64(conf.LWM)/100)
+				used, total, pct, _ = diskUsage(dev)
+				log.Printf("diskmon: %s evicted %d objects, %d bytes; now %d out of %d bytes or %d%%\n",
+					path, count, freed, used, total, pct)
 			}
 
-			for pct > LWM {
-				log.Printf("diskmon: %d out of %d bytes or %d%% -- commencing cleanup\n", used, total, pct)
-				deleteSomeFiles()
-				used, total, pct = diskUsage()
+			if time.Since(lastCheckpoint) >= CHECKPOINTINTERVAL*time.Minute {
+				if err := cache.Checkpoint(); err != nil {
+					log.Println("diskmon: cannot checkpoint cache index --", err)
+				}
+				lastCheckpoint = time.Now()
 			}
+
+			time.Sleep(REFRESHINTERVAL * time.Minute)
 		}
 	}()
 }
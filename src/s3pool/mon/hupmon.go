@@ -0,0 +1,38 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package mon
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"s3pool/conf"
+	"s3pool/op"
+	"syscall"
+)
+
+// Reload the config file on SIGHUP
+func Hupmon() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reply, err := op.Reload(nil)
+			if err != nil {
+				log.Printf("SIGHUP: reload failed -- %v\n", err)
+				continue
+			}
+			log.Printf("SIGHUP: reloaded %s\n%s", conf.ConfigFile, reply)
+		}
+	}()
+}
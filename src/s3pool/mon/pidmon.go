@@ -15,6 +15,7 @@ package mon
 import (
 	"log"
 	"os"
+	"s3pool/conf"
 	"s3pool/pidfile"
 	"time"
 )
@@ -25,7 +26,12 @@ func Pidmon() {
 			pid := pidfile.Read()
 			if pid != os.Getpid() {
 				log.Println("pidfile has changed. s3pool exiting ...")
-				os.Exit(0)
+				select {
+				case conf.ShutdownChannel <- conf.ShutdownTimeout:
+				default:
+					// shutting down already
+				}
+				return
 			}
 			time.Sleep(60 * time.Second)
 		}
@@ -13,6 +13,8 @@
 package op
 
 import (
+	"fmt"
+	"log"
 	"os"
 	"s3pool/cat"
 	"s3pool/conf"
@@ -47,30 +49,45 @@ func fileMtimeSince(path string) (time.Duration, error) {
 // Check that we have a catalog on bucket. If not, create it.
 func checkCatalog(bucket string) error {
 
-	// serialize refresh on bucket
+	// serialize the check on bucket. The lock is not held during the
+	// wait: callers that wait together share the one refresh.
 	lockname, err := strlock.Lock("refresh " + bucket)
 	if err != nil {
 		return err
 	}
-	defer strlock.Unlock(lockname)
 
 	ok, err := cat.Exists(bucket)
+	if ok && err == nil {
+		strlock.Unlock(lockname)
+		return nil
+	}
 	if err != nil {
-		return err
+		// the last refresh failed; try again
+		log.Printf("catalog of %s has error, refreshing -- %v\n", bucket, err)
 	}
-	if !ok {
-		// notify bucketmon; it will invoke refresh to create entry in catalog.
-		conf.NotifyBucketmon(bucket)
 
-		// wait for it
-		for !ok {
-			time.Sleep(time.Second)
-			ok, err = cat.Exists(bucket)
-			if err != nil {
-				return err
-			}
+	// notify bucketmon; it will invoke refresh to create entry in
+	// catalog at once, even if the bucket is scheduled for later.
+	done := awaitRefresh(bucket)
+	conf.NotifyBucketmonWaiting(bucket)
+	strlock.Unlock(lockname)
+
+	// wait for it
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("refresh of %s failed -- %v", bucket, err)
 		}
+	case <-time.After(time.Duration(conf.CatalogWait) * time.Second):
+		return fmt.Errorf("timed out waiting for refresh of %s", bucket)
 	}
 
+	ok, err = cat.Exists(bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no catalog for %s", bucket)
+	}
 	return nil
 }
@@ -0,0 +1,81 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"github.com/cktan/glob"
+	"log"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/strlock"
+	"strings"
+)
+
+/*
+ *  arg0: bucket name
+ *  arg1: a key, or a glob pattern on the keys of cached objects
+ *
+ *  Remove the data file, meta file and lander outputs of each object,
+ *  and clear its catalog entry so that the next PULL goes to the source.
+ *  Reply the keys evicted. Keys not cached, and objects pushed in
+ *  write-back mode and not uploaded yet, are skipped.
+ */
+func Evict(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("expects 2 arguments for EVICT")
+	}
+	bucket, pattern := args[0], args[1]
+
+	var keys []string
+	if strings.ContainsAny(pattern, "*?[{") {
+		g, err := glob.Compile(pattern, '/')
+		if err != nil {
+			return "", err
+		}
+		keys = cache.Keys(bucket, func(key string) bool {
+			return g.Match(key)
+		})
+	} else {
+		keys = []string{pattern}
+	}
+
+	ctx := strlock.WithOwner(workCtx, "EVICT")
+	var reply strings.Builder
+	for _, key := range keys {
+		lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+		if err != nil {
+			return "", err
+		}
+		if writebackPending(bucket, key) || len(cache.Files(bucket, key)) == 0 {
+			// the file pushed is the only copy until it is uploaded;
+			// a key not cached keeps its catalog entry
+			strlock.Unlock(lockname)
+			continue
+		}
+		err = cache.Remove(bucket, key)
+		if err == nil {
+			cat.Delete(bucket, key)
+		}
+		strlock.Unlock(lockname)
+
+		if err != nil {
+			log.Printf("EVICT %s:%s failed -- %v\n", bucket, key, err)
+			return "", err
+		}
+		reply.WriteString(key)
+		reply.WriteString("\n")
+	}
+
+	return reply.String(), nil
+}
@@ -0,0 +1,68 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/cat"
+	"testing"
+)
+
+// Run the test in a temp dir holding data/bucket/key and its meta file
+func cacheKey(t *testing.T, bucket, key string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	path := filepath.Join("data", bucket, key)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	ioutil.WriteFile(path, []byte("data"), 0644)
+	ioutil.WriteFile(path+"__meta__", []byte("{}"), 0644)
+}
+
+func TestEvict(t *testing.T) {
+	cacheKey(t, "b", "k")
+	save := cat.UseS3Meta
+	cat.UseS3Meta = false
+	defer func() { cat.UseS3Meta = save }()
+	cat.Store("b", []string{"k", "other"}, []string{"e1", "e2"}, nil)
+
+	// a key that is not cached is not evicted
+	reply, err := Evict([]string{"b", "other"})
+	if err != nil || reply != "" {
+		t.Errorf("Evict of a key not cached = %q, %v; want nothing", reply, err)
+	}
+	if etag := cat.Find("b", "other"); etag != "e2" {
+		t.Errorf("catalog entry of a key not cached is %q, want e2", etag)
+	}
+
+	reply, err = Evict([]string{"b", "k"})
+	if err != nil || reply != "k\n" {
+		t.Errorf("Evict = %q, %v; want k", reply, err)
+	}
+	if etag := cat.Find("b", "k"); etag != "" {
+		t.Errorf("catalog entry of an evicted key is %q, want none", etag)
+	}
+	for _, path := range []string{"data/b/k", "data/b/k__meta__"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+}
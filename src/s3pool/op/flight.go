@@ -0,0 +1,103 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"s3pool/conf"
+	"sync"
+)
+
+// A flight is one download and conversion of bucket:key for a variant
+// (filespec and schema). Requests for the same flight while it is
+// queued or running join it and share its result, including its error,
+// instead of downloading again.
+type flight struct {
+	done    chan struct{} // closed when path and err are set
+	path    string
+	err     error
+	pri     int  // highest priority the flight is queued at
+	started bool // a worker has taken it
+}
+
+var flights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: make(map[string]*flight)}
+
+func flightName(filespec string, schemabytes []byte, bucket, key string) string {
+	sum := sha1.Sum(schemabytes)
+	return bucket + ":" + key + "\x00" + filespec + "\x00" + hex.EncodeToString(sum[:])
+}
+
+// Join the flight of bucket:key for the variant, queueing it at
+// priority pri on behalf of client if it is not queued at pri or higher
+// yet. Returns the flight and whether it was already there.
+func joinFlight(ctx context.Context, pri int, client, filespec, schemafn string, schemabytes []byte, bucket, key string) (*flight, bool) {
+	name := flightName(filespec, schemabytes, bucket, key)
+
+	flights.Lock()
+	f := flights.m[name]
+	joined := f != nil
+	if joined {
+		conf.CountPullShared++
+		if f.started || f.pri <= pri {
+			flights.Unlock()
+			return f, joined
+		}
+		// queued behind lower priority work; queue it again at pri and
+		// let whichever job comes first run it
+		f.pri = pri
+	} else {
+		f = &flight{done: make(chan struct{}), pri: pri}
+		flights.m[name] = f
+	}
+	flights.Unlock()
+
+	err := pullQueue.AddPriority(pri, client, func(int) {
+		flights.Lock()
+		if f.started {
+			flights.Unlock()
+			return
+		}
+		f.started = true
+		flights.Unlock()
+
+		path, err := pullOne(ctx, filespec, schemafn, schemabytes, bucket, key)
+
+		flights.Lock()
+		delete(flights.m, name)
+		f.path, f.err = path, err
+		flights.Unlock()
+		close(f.done)
+	}, 0)
+	if err != nil && !joined {
+		// shutting down; a flight joined is left to the job that
+		// was queued for it before
+		flights.Lock()
+		delete(flights.m, name)
+		f.err = err
+		flights.Unlock()
+		close(f.done)
+	}
+
+	return f, joined
+}
+
+// Wait for the flight to land
+func (f *flight) wait() (string, error) {
+	<-f.done
+	return f.path, f.err
+}
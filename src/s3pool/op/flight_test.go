@@ -0,0 +1,151 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"context"
+	"os"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/jobqueue"
+	"s3pool/strlock"
+	"testing"
+	"time"
+)
+
+// Pull from an empty local source tree on a queue of one worker, so
+// that every download fails at once unless its key is locked
+func oneWorker(t *testing.T) {
+	wd, _ := os.Getwd()
+	home := t.TempDir()
+	if err := os.Chdir(home); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir("tmp", 0755)
+
+	saveQueue, saveMode, saveSrc, saveMeta := pullQueue, conf.DfsMode, conf.SrcPrefix, cat.UseS3Meta
+	pullQueue = jobqueue.New(1)
+	conf.DfsMode, conf.SrcPrefix, cat.UseS3Meta = conf.DFS_LOCAL, home, false
+	t.Cleanup(func() {
+		pullQueue.Destroy()
+		pullQueue, conf.DfsMode, conf.SrcPrefix, cat.UseS3Meta = saveQueue, saveMode, saveSrc, saveMeta
+		os.Chdir(wd)
+	})
+}
+
+func fly(pri int, client, schema, key string) (*flight, bool) {
+	return joinFlight(context.Background(), pri, client, "{}", "s.schema", []byte(schema), "fb", key)
+}
+
+func landed(f *flight) bool {
+	select {
+	case <-f.done:
+		return true
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func grounded(f *flight) bool {
+	select {
+	case <-f.done:
+		return false
+	case <-time.After(100 * time.Millisecond):
+		return true
+	}
+}
+
+func TestFlightShared(t *testing.T) {
+	oneWorker(t)
+	lockname, _ := strlock.Lock("fb:k")
+
+	shared := conf.CountPullShared
+	f1, joined1 := fly(jobqueue.NORMAL, "a", "s1", "k")
+	f2, joined2 := fly(jobqueue.NORMAL, "b", "s1", "k")
+	f3, joined3 := fly(jobqueue.NORMAL, "a", "s2", "k")
+	if joined1 || !joined2 || f1 != f2 {
+		t.Error("a second request for the same variant did not join the flight")
+	}
+	if joined3 || f3 == f1 {
+		t.Error("a request for another schema joined the flight")
+	}
+	if conf.CountPullShared != shared+1 {
+		t.Errorf("count_pull_shared went up by %d, want 1", conf.CountPullShared-shared)
+	}
+
+	strlock.Unlock(lockname)
+	_, err1 := f1.wait()
+	_, err2 := f2.wait()
+	if err1 == nil || err1 != err2 {
+		t.Errorf("joined requests got %v and %v, want the same error", err1, err2)
+	}
+	if !landed(f3) {
+		t.Error("flight of the other schema did not run")
+	}
+
+	// a request after the flight landed starts a new one
+	if f4, joined := fly(jobqueue.NORMAL, "a", "s1", "k"); joined || f4 == f1 {
+		t.Error("a request after the flight landed joined it")
+	}
+}
+
+func TestFlightPriority(t *testing.T) {
+	oneWorker(t)
+	busy, _ := strlock.Lock("fb:busy")
+	backlog, _ := strlock.Lock("fb:backlog")
+	defer strlock.Unlock(backlog)
+
+	// the worker is busy, and a backlog of low priority work waits
+	fbusy, _ := fly(jobqueue.NORMAL, "x", "s", "busy")
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		fly(jobqueue.LOW, "x", string(rune('0'+i)), "backlog")
+	}
+
+	f, _ := fly(jobqueue.LOW, "y", "s", "k")
+	if g, joined := fly(jobqueue.HIGH, "z", "s", "k"); !joined || g != f || f.pri != jobqueue.HIGH {
+		t.Fatal("a high priority request did not raise the flight it joined")
+	}
+
+	// the flight runs ahead of the backlog, which would hold the worker
+	strlock.Unlock(busy)
+	if !landed(fbusy) || !landed(f) {
+		t.Error("flight raised to high priority waits behind low priority work")
+	}
+}
+
+func TestFlightRoundRobin(t *testing.T) {
+	oneWorker(t)
+	busy, _ := strlock.Lock("fb:busy")
+	a2, _ := strlock.Lock("fb:a2")
+
+	fbusy, _ := fly(jobqueue.NORMAL, "x", "s", "busy")
+	time.Sleep(50 * time.Millisecond)
+	fa1, _ := fly(jobqueue.NORMAL, "a", "s", "a1")
+	fa2, _ := fly(jobqueue.NORMAL, "a", "s", "a2")
+	fa3, _ := fly(jobqueue.NORMAL, "a", "s", "a3")
+	fb1, _ := fly(jobqueue.NORMAL, "b", "s", "b1")
+
+	// a1, b1 and then a2, which holds the worker on its lock
+	strlock.Unlock(busy)
+	if !landed(fbusy) || !landed(fa1) || !landed(fb1) {
+		t.Fatal("the flight of client b waits behind those of client a")
+	}
+	if !grounded(fa3) {
+		t.Error("a3 ran before a2")
+	}
+	strlock.Unlock(a2)
+	if !landed(fa2) || !landed(fa3) {
+		t.Error("flights of client a did not run")
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/cache"
+	"strings"
+)
+
+/*
+ *  arg0: optional "repair" to remove the broken files
+ *
+ *  Check the files of the cache. Reply one line per problem, TAB
+ *  delimited:
+ *
+ *	action<TAB>path<TAB>reason
+ *
+ *  where action is found, removed or failed, and path is a file or
+ *  bucket:key for a whole cached object.
+ */
+func Fsck(args []string) (string, error) {
+	repair := false
+	if len(args) == 1 && strings.ToLower(args[0]) == "repair" {
+		repair = true
+	} else if len(args) != 0 {
+		return "", errors.New("expects no argument or \"repair\" for FSCK")
+	}
+
+	var reply strings.Builder
+	for _, p := range cache.Fsck(repair) {
+		fmt.Fprintf(&reply, "%s\t%s\t%s\n", p.Action, p.Path, p.Reason)
+	}
+	if reply.Len() == 0 {
+		return "\n", nil
+	}
+	return reply.String(), nil
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/cktan/glob"
 	"s3pool/cat"
 	"s3pool/conf"
+	"sort"
 	"strings"
 )
 
@@ -27,36 +28,58 @@ func globPrefix(pattern string) string {
 	return s
 }
 
-func Glob(args []string) (string, error) {
-	conf.CountGlob++
-
-	var err error
-
-	if len(args) != 2 {
-		return "", errors.New("expects 2 arguments for GLOB")
-	}
-	bucket, pattern := args[0], args[1]
-
-	if err = checkCatalog(bucket); err != nil {
-		return "", err
+// Return the keys in the catalog of bucket that match pattern
+func globKeys(bucket, pattern string) ([]string, error) {
+	if err := checkCatalog(bucket); err != nil {
+		return nil, err
 	}
 
 	// prepare the pattern glob
 	g, err := glob.Compile(pattern, '/')
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	filter := func(key string) bool {
 		return g.Match(key)
 	}
 	var prefix string
-	if conf.DfsMode != conf.DFS_S3 && conf.DfsMode != conf.DFS_GCS {
+	if mode := conf.BucketDfsMode(bucket); mode != conf.DFS_S3 && mode != conf.DFS_GCS {
 		prefix = pattern
 	} else {
 		prefix = globPrefix(pattern)
 	}
-	key := cat.Scan(bucket, prefix, filter)
+	keys := cat.Scan(bucket, prefix, filter)
+
+	// keys pushed in write-back mode are in the catalog only once
+	// they are uploaded
+	if pending := writebackKeys(bucket, filter); len(pending) > 0 {
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			seen[key] = true
+		}
+		for _, key := range pending {
+			if !seen[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+	return keys, nil
+}
+
+func Glob(args []string) (string, error) {
+	conf.CountGlob++
+
+	if len(args) != 2 {
+		return "", errors.New("expects 2 arguments for GLOB")
+	}
+	bucket, pattern := args[0], args[1]
+
+	key, err := globKeys(bucket, pattern)
+	if err != nil {
+		return "", err
+	}
 
 	var replyBuilder strings.Builder
 	for i := range key {
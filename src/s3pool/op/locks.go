@@ -0,0 +1,48 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/strlock"
+	"strings"
+	"time"
+)
+
+/*
+ *  List the locks held and waited on, one per line:
+ *
+ *	held<TAB>name<TAB>owner<TAB>seconds
+ *	wait<TAB>name<TAB>owner<TAB>seconds
+ *
+ *  Each held line is followed by the wait lines of its waiters.
+ */
+func Locks(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("expects no argument for LOCKS")
+	}
+
+	now := time.Now()
+	var reply strings.Builder
+	for _, l := range strlock.Locks() {
+		fmt.Fprintf(&reply, "held\t%s\t%s\t%d\n", l.Name, l.Owner, int(now.Sub(l.Since).Seconds()))
+		for _, w := range l.Waiters {
+			fmt.Fprintf(&reply, "wait\t%s\t%s\t%d\n", l.Name, w.Owner, int(now.Sub(w.Since).Seconds()))
+		}
+	}
+	if reply.Len() == 0 {
+		return "\n", nil
+	}
+	return reply.String(), nil
+}
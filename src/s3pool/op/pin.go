@@ -0,0 +1,49 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/cache"
+)
+
+/*
+ *  arg0: bucket name
+ *  arg1: glob pattern on keys
+ */
+func Pin(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("expects 2 arguments for PIN")
+	}
+	bucket, pattern := args[0], args[1]
+
+	count, nbytes, err := cache.PinObjects(bucket, pattern, false)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d objects %d bytes\n", count, nbytes), nil
+}
+
+func Unpin(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("expects 2 arguments for UNPIN")
+	}
+	bucket, pattern := args[0], args[1]
+
+	count, nbytes, err := cache.UnpinObjects(bucket, pattern, false)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d objects %d bytes\n", count, nbytes), nil
+}
@@ -0,0 +1,81 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"log"
+	"os"
+	"s3pool/conf"
+	"s3pool/jobqueue"
+	"s3pool/strlock"
+)
+
+/*
+ *  arg0: bucket name
+ *  arg1: filespec is in JSON {"fmt" :"csv", "csvspec" : {"delim" : ",", ... } in single line
+ *  arg2: schema filename
+ *  arg3: glob pattern on keys
+ *
+ *  Pull the matching keys in the background at LOW priority and
+ *  return immediately.
+ */
+func Prefetch(args []string, client string) (string, error) {
+	conf.CountPrefetch++
+	if len(args) != 4 {
+		return "", errors.New("expects 4 arguments for PREFETCH")
+	}
+	bucket, filespec, schemafn, pattern := args[0], args[1], args[2], args[3]
+	filespec, schemafn, err := bucketDefaults(bucket, filespec, schemafn)
+	if err != nil {
+		return "", err
+	}
+
+	// the schema file must be there when the job runs, so check it now
+	schemabytes, err := os.ReadFile(schemafn)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := strlock.WithOwner(bgCtx, "PREFETCH "+client)
+	go func() {
+		keys, err := globKeys(bucket, pattern)
+		if err != nil {
+			log.Printf("PREFETCH %s %s failed -- %v\n", bucket, pattern, err)
+			return
+		}
+
+		// keys already in flight are skipped
+		var started []*flight
+		var startedKey []string
+		for _, key := range keys {
+			f, joined := joinFlight(ctx, jobqueue.LOW, client, filespec, schemafn, schemabytes, bucket, key)
+			if !joined {
+				started = append(started, f)
+				startedKey = append(startedKey, key)
+			}
+		}
+
+		if conf.Verbose(1) {
+			log.Printf("PREFETCH %s %s queued %d keys\n", bucket, pattern, len(started))
+		}
+
+		for i, f := range started {
+			if _, err := f.wait(); err != nil {
+				log.Printf("PREFETCH %s:%s failed -- %v\n", bucket, startedKey[i], err)
+			}
+		}
+	}()
+
+	return "\n", nil
+}
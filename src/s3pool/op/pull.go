@@ -14,8 +14,10 @@ package op
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os"
+	"s3pool/cache"
 	"s3pool/cat"
 	"s3pool/conf"
 	"s3pool/hdfs"
@@ -27,111 +29,140 @@ import (
 	"s3pool/gcs"
 	"s3pool/strlock"
 	"strings"
-	"sync"
 )
 
-var pullQueue = jobqueue.New(conf.PullConcurrency)
+// All downloads go through pullQueue. PULL runs at NORMAL priority
+// unless the client asks otherwise; PREFETCH runs at LOW priority on at
+// most conf.BackgroundConcurrency workers.
+var pullQueue = newPullQueue()
+
+func newPullQueue() *jobqueue.JobQueue {
+	jq := jobqueue.New(conf.PullConcurrency)
+	jq.SetLimit(jobqueue.LOW, conf.BackgroundConcurrency)
+	return jq
+}
+
+// Download bucket:key if it is not cached or has changed, and convert
+// it with xrgdiv. Returns the path of the zmp file.
+func pullOne(ctx context.Context, filespec, schemafn string, schemabytes []byte, bucket, key string) (string, error) {
+	// lock to serialize pull on same (bucket:key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return "", err
+	}
+	defer strlock.Unlock(lockname)
+
+	var path, metapath string
+	var hit bool
+	mode := conf.BucketDfsMode(bucket)
+	pending := writebackPending(bucket, key)
+	if pending {
+		// pushed in write-back mode and not uploaded yet, so the
+		// cached object is the latest
+		if path, err = dataPath(bucket, key); err == nil {
+			metapath = path + "__meta__"
+			hit = true
+		}
+	} else if mode == conf.DFS_HDFS {
+		path, metapath, hit, err = hdfs.GetObject(ctx, bucket, key, false)
+	} else if mode == conf.DFS_HDFS2X {
+		path, metapath, hit, err = hdfs2x.GetObject(ctx, bucket, key, false)
+	} else if mode == conf.DFS_S3 {
+		path, metapath, hit, err = s3.GetObject(ctx, bucket, key, false)
+	} else if mode == conf.DFS_LOCAL {
+		path, metapath, hit, err = local.GetObject(ctx, bucket, key, false)
+	} else if mode == conf.DFS_GCS {
+		path, metapath, hit, err = gcs.GetObject(ctx, bucket, key, false)
+	}
+
+	// check the zmp filepath and return it. A cached source without
+	// its zmp file, as kept after a PUSH, is converted below.
+	if zmppath, zerr := lander.FindZMPFile(bucket, key); hit && zerr == nil {
+		conf.CountPullHit++
+
+		match, err := lander.CheckSchema(bytes.NewReader(schemabytes), zmppath, filespec)
+		if err != nil || match == false {
+			return "", err
+		}
+		cache.Touch(bucket, key)
+		return zmppath, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// check zmp filepath exists. if exists, delete the zmpfile
+	zmppath, err := lander.FindZMPFile(bucket, key)
+	if err == nil {
+		lander.RemoveXrgFile(zmppath)
+	}
+	// convert path to zmpfile and return it
+	zmppath, err = lander.Xrgdiv(ctx, bucket, key, schemafn, filespec)
+	if err != nil {
+		// whatever xrgdiv wrote before it failed
+		if zmppath, err := lander.FindZMPFile(bucket, key); err == nil {
+			lander.RemoveXrgFile(zmppath)
+		}
+		if pending {
+			// the file pushed is the only copy
+			return "", err
+		}
+		// remove the source file if xrgdiv failed
+		// For local, metafile is in data directory and path is the source path which is not in data directory
+		if mode != conf.DFS_LOCAL {
+			os.Remove(path)
+		}
+		os.Remove(metapath)
+		cache.Forget(bucket, key)
+		cat.Delete(bucket, key)
+		return "", err
+	}
+	cache.Add(bucket, key)
+	return zmppath, nil
+}
 
 /*
  *  arg0: filespec is in JSON {"fmt" :"csv", "csvspec" : {"delim" : ",", ... } in single line
  *  arg1: schema filename
  *  arg2: bucket name
  *  arg3.. keys
+ *
+ *  The downloads are queued at priority pri on behalf of client.
  */
-func Pull(args []string) (string, error) {
+func Pull(args []string, pri int, client string) (string, error) {
 	conf.CountPull++
 	if len(args) < 4 {
 		return "", errors.New("Expected at least 4 arguments for PULL")
 	}
 	filespec, schemafn, bucket, keys := args[0], args[1], args[2], args[3:]
+	filespec, schemafn, err := bucketDefaults(bucket, filespec, schemafn)
+	if err != nil {
+		return "", err
+	}
 	if err := checkCatalog(bucket); err != nil {
 		return "", err
 	}
 
 	nkeys := len(keys)
 	path := make([]string, nkeys)
-	metapath := make([]string, nkeys)
 	patherr := make([]error, nkeys)
-	waitGroup := sync.WaitGroup{}
-	var hit bool
 
 	schemabytes, err := os.ReadFile(schemafn)
 	if err != nil {
 		return "", err
 	}
 
-	dowork := func(i int) {
-
-		// lock to serialize pull on same (bucket:key)
-		lockname, err := strlock.Lock(bucket + ":" + keys[i])
-		if err != nil {
-			return
-		}
-		defer strlock.Unlock(lockname)
-
-		if conf.DfsMode == conf.DFS_HDFS {
-			path[i], metapath[i], hit, patherr[i] = hdfs.GetObject(bucket, keys[i], false)
-		} else if conf.DfsMode == conf.DFS_HDFS2X {
-			path[i], metapath[i], hit, patherr[i] = hdfs2x.GetObject(bucket, keys[i], false)
-		} else if conf.DfsMode == conf.DFS_S3 {
-			path[i], metapath[i], hit, patherr[i] = s3.GetObject(bucket, keys[i], false)
-		} else if conf.DfsMode == conf.DFS_LOCAL {
-			path[i], metapath[i], hit, patherr[i] = local.GetObject(bucket, keys[i], false)
-		} else if conf.DfsMode == conf.DFS_GCS {
-			path[i], metapath[i], hit, patherr[i] = gcs.GetObject(bucket, keys[i], false)
-		}
-
-		if hit {
-			conf.CountPullHit++
-			// check the zmp filepath and return to path[i]
-			zmppath, err := lander.FindZMPFile(bucket, keys[i])
-			if err != nil {
-				path[i] = ""
-				patherr[i] = errors.New("s3 file cache hit but zmp file not exists")
-			}
-
-			match, err := lander.CheckSchema(bytes.NewReader(schemabytes), zmppath, filespec)
-			if err != nil || match == false {
-				path[i] = ""
-				patherr[i] = err
-			} else {
-				path[i] = zmppath
-			}
-
-		} else {
-			if patherr[i] == nil {
-				// check zmp filepath exists. if exists, delete the zmpfile
-				zmppath, err := lander.FindZMPFile(bucket, keys[i])
-				if err == nil {
-					lander.RemoveXrgFile(zmppath)
-				}
-				// convert path[i] to zmpfile and return to path[i]
-				zmppath, err = lander.Xrgdiv(bucket, keys[i], schemafn, filespec)
-				if err != nil {
-					// remove the source file if xrgdiv failed
-					// For local, metafile is in data directory and path[i] is the source path which is not in data directory
-					if conf.DfsMode != conf.DFS_LOCAL {
-						os.Remove(path[i])
-					}
-					os.Remove(metapath[i])
-					cat.Delete(bucket, keys[i])
-					path[i] = ""
-					patherr[i] = err
-				} else {
-					path[i] = zmppath
-				}
-			}
-
-		}
-		waitGroup.Done()
+	// download nkeys in parallel, sharing the downloads already in
+	// flight for the same keys
+	ctx := strlock.WithOwner(workCtx, "PULL "+client)
+	inflight := make([]*flight, nkeys)
+	for i := 0; i < nkeys; i++ {
+		inflight[i], _ = joinFlight(ctx, pri, client, filespec, schemafn, schemabytes, bucket, keys[i])
 	}
-
-	// download nkeys in parallel
-	waitGroup.Add(nkeys)
 	for i := 0; i < nkeys; i++ {
-		pullQueue.Add(dowork, i)
+		path[i], patherr[i] = inflight[i].wait()
 	}
-	waitGroup.Wait()
 
 	var reply strings.Builder
 	for i := 0; i < nkeys; i++ {
@@ -16,9 +16,21 @@ import (
 	"errors"
 	"fmt"
 	"s3pool/conf"
+	"s3pool/gcs"
+	"s3pool/hdfs"
+	"s3pool/hdfs2x"
+	"s3pool/local"
 	"s3pool/s3"
+	"s3pool/strlock"
 )
 
+// Complete or abort the multipart uploads to s3 that were in progress
+// when s3pool last stopped. The uploads of write-back PUSHes are left
+// to the write-back uploader.
+func InitUploads() {
+	go s3.ResumeUploads(strlock.WithOwner(workCtx, "PUSH"), isStaged)
+}
+
 func Push(args []string) (string, error) {
 	conf.CountPush++
 	if len(args) != 3 {
@@ -32,7 +44,26 @@ func Push(args []string) (string, error) {
 		return "", err
 	}
 
-	err := s3.PutObject(bucket, key, path)
+	ctx := strlock.WithOwner(workCtx, "PUSH")
+	var err error
+	mode := conf.BucketDfsMode(bucket)
+	if mode != conf.DFS_LOCAL && (conf.PushMode == "writeback" || writebackPending(bucket, key)) {
+		// a PUSH of a key that waits for its upload goes after it
+		err = pushWriteback(ctx, bucket, key, path)
+	} else {
+		switch mode {
+		case conf.DFS_HDFS:
+			err = hdfs.PutObject(ctx, bucket, key, path)
+		case conf.DFS_HDFS2X:
+			err = hdfs2x.PutObject(ctx, bucket, key, path)
+		case conf.DFS_LOCAL:
+			err = local.PutObject(ctx, bucket, key, path)
+		case conf.DFS_GCS:
+			err = gcs.PutObject(ctx, bucket, key, path)
+		default:
+			err = s3.PutObject(ctx, bucket, key, path)
+		}
+	}
 	if err != nil {
 		return "", err
 	}
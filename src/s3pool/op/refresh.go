@@ -13,30 +13,109 @@
 package op
 
 import (
+	"context"
 	"errors"
 	"log"
 	"s3pool/cat"
 	"s3pool/conf"
 	"s3pool/s3"
 	"s3pool/s3meta"
+	"sync"
+	"time"
 )
 
+// channels of the requests waiting for the next refresh of a bucket
+var refreshWait = struct {
+	sync.Mutex
+	m map[string][]chan error
+}{m: make(map[string][]chan error)}
+
+// Return a channel that receives the error of the next refresh of
+// bucket when it finishes
+func awaitRefresh(bucket string) <-chan error {
+	ch := make(chan error, 1)
+	refreshWait.Lock()
+	refreshWait.m[bucket] = append(refreshWait.m[bucket], ch)
+	refreshWait.Unlock()
+	return ch
+}
+
+func refreshDone(bucket string, err error) {
+	refreshWait.Lock()
+	waiters := refreshWait.m[bucket]
+	delete(refreshWait.m, bucket)
+	refreshWait.Unlock()
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// outcome of the refreshes of a bucket
+type RefreshStat struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string
+	Keys        int           // # keys listed by the last success
+	Elapsed     time.Duration // time taken by the last refresh
+}
+
+var refreshStat = struct {
+	sync.Mutex
+	m map[string]*RefreshStat
+}{m: make(map[string]*RefreshStat)}
+
+func recordRefresh(bucket string, start time.Time, nkeys int, err error) {
+	refreshStat.Lock()
+	defer refreshStat.Unlock()
+	st := refreshStat.m[bucket]
+	if st == nil {
+		st = &RefreshStat{}
+		refreshStat.m[bucket] = st
+	}
+	now := time.Now()
+	st.Elapsed = now.Sub(start)
+	if err != nil {
+		st.LastFailure = now
+		st.LastError = err.Error()
+	} else {
+		st.LastSuccess = now
+		st.Keys = nkeys
+	}
+}
+
+// Return a copy of the refresh outcome of each bucket refreshed
+func RefreshStats() map[string]RefreshStat {
+	refreshStat.Lock()
+	defer refreshStat.Unlock()
+	ret := make(map[string]RefreshStat, len(refreshStat.m))
+	for bucket, st := range refreshStat.m {
+		ret[bucket] = *st
+	}
+	return ret
+}
+
 /*
 1. List all objects in bucket
 2. save the key[] and etag[] to catalog
 */
 func Refresh(args []string) (string, error) {
-	conf.CountRefresh++
-
 	if len(args) != 1 {
 		return "", errors.New("expects 1 argument for REFRESH")
 	}
-	bucket := args[0]
+	return refresh(workCtx, args[0])
+}
+
+func refresh(ctx context.Context, bucket string) (string, error) {
+	conf.CountRefresh++
+
 	// DO NOT checkCatalog here. We will update it!
+	startTime := time.Now()
 
 	if cat.UseS3Meta {
 		log.Println(" ... invalidate s3meta bucket", bucket)
 		s3meta.Invalidate(bucket)
+		recordRefresh(bucket, startTime, 0, nil)
+		refreshDone(bucket, nil)
 		return "\n", nil
 	}
 
@@ -63,8 +142,10 @@ func Refresh(args []string) (string, error) {
 		numItems++
 	}
 
-	err := s3.ListObjects(bucket, "", save)
+	err := s3.ListObjects(ctx, bucket, "", save)
 	cat.Store(bucket, key, etag, err)
+	recordRefresh(bucket, startTime, numItems, err)
+	refreshDone(bucket, err)
 
 	if err != nil {
 		return "", err
@@ -72,3 +153,12 @@ func Refresh(args []string) (string, error) {
 
 	return "\n", nil
 }
+
+// Refresh bucket as background work, canceled on shutdown. Bucketmon
+// limits the refreshes run at once to conf.RefreshConcurrency, apart
+// from the downloads on pullQueue, so that a request waiting for a
+// catalog does not wait behind PREFETCH.
+func RefreshBackground(bucket string) error {
+	_, err := refresh(bgCtx, bucket)
+	return err
+}
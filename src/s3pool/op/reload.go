@@ -0,0 +1,262 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/conf"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type configSetting struct {
+	kind    string // int, bool, quota, backend, path or list
+	restart bool   // takes effect on the next start only
+}
+
+// Settings of the config file besides the tunables, which are applied
+// as by SET
+var configSettings = map[string]configSetting{
+	"home":           {"path", true},
+	"port":           {"int", true},
+	"pidfile":        {"path", true},
+	"no_daemon":      {"bool", true},
+	"devices":        {"list", true},
+	"dfs":            {"backend", true},
+	"src_prefix":     {"path", true},
+	"rows_per_group": {"int", true},
+	"quota":          {"quota", false},
+}
+
+// the config file as last read
+var lastConfig struct {
+	sync.Mutex
+	cfg conf.Config
+}
+
+func checkConfigValue(kind, value string) error {
+	var err error
+	switch kind {
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "quota":
+		nv := strings.SplitN(value, "=", 2)
+		if len(nv) != 2 || nv[0] == "" {
+			return errors.New("expects bucket=size")
+		}
+		_, err = conf.ParseSize(nv[1])
+	case "backend":
+		_, err = conf.ParseBackend(value)
+	case "path", "list":
+		if value == "" {
+			err = errors.New("expects a value")
+		}
+	}
+	return err
+}
+
+// Validate all settings of cfg
+func CheckConfig(cfg conf.Config) error {
+	for name, values := range cfg {
+		if t := findTunable(name); t != nil {
+			if len(values) != 1 {
+				return fmt.Errorf("%s -- expects one value", name)
+			}
+			if _, err := t.parse(strings.ToLower(values[0])); err != nil {
+				return fmt.Errorf("%s -- %v", name, err)
+			}
+			continue
+		}
+		s, ok := configSettings[name]
+		if !ok {
+			return fmt.Errorf("Unknown setting %s", name)
+		}
+		if len(values) != 1 && s.kind != "list" && s.kind != "quota" {
+			return fmt.Errorf("%s -- expects one value", name)
+		}
+		for _, v := range values {
+			if err := checkConfigValue(s.kind, v); err != nil {
+				return fmt.Errorf("%s -- %v", name, err)
+			}
+		}
+	}
+
+	hwm, lwm := conf.HWM, conf.LWM
+	if v, ok := cfg["hwm"]; ok {
+		hwm, _ = strconv.Atoi(v[0])
+	}
+	if v, ok := cfg["lwm"]; ok {
+		lwm, _ = strconv.Atoi(v[0])
+	}
+	if !(0 < lwm && lwm < hwm && hwm < 100) {
+		return errors.New("Invalid water marks. Expects 0 < lwm < hwm < 100.")
+	}
+	return nil
+}
+
+// Apply setting name, changing from the values old to cur
+func applySetting(name string, old, cur []string) error {
+	if name == "quota" {
+		// buckets dropped from the list lose their quota
+		keep := make(map[string]bool)
+		for _, q := range cur {
+			keep[strings.SplitN(q, "=", 2)[0]] = true
+		}
+		for _, q := range old {
+			if bucket := strings.SplitN(q, "=", 2)[0]; !keep[bucket] {
+				if _, err := SetB([]string{bucket, name, ""}); err != nil {
+					return err
+				}
+			}
+		}
+		for _, q := range cur {
+			nv := strings.SplitN(q, "=", 2)
+			if _, err := SetB([]string{nv[0], name, nv[1]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err := Set([]string{name, cur[0]})
+	return err
+}
+
+// Return the names of cfg in the order they can be applied
+func configNames(cfg conf.Config) []string {
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// lower lwm before hwm, so that lwm < hwm holds after each step
+	if v, ok := cfg["lwm"]; ok {
+		if lwm, _ := strconv.Atoi(v[0]); lwm < conf.LWM {
+			h, l := -1, -1
+			for i, name := range names {
+				if name == "hwm" {
+					h = i
+				} else if name == "lwm" {
+					l = i
+				}
+			}
+			if h >= 0 && h < l {
+				copy(names[h+1:l+1], names[h:l])
+				names[h] = "lwm"
+			}
+		}
+	}
+	return names
+}
+
+// Apply the config file read at startup, skipping the settings given
+// by command line flags which main has applied already. Call after the
+// bucket monitor started.
+func InitConfig(cfg conf.Config, flagged map[string]bool) error {
+	lastConfig.Lock()
+	defer lastConfig.Unlock()
+	for _, name := range configNames(cfg) {
+		if configSettings[name].restart || flagged[name] {
+			continue
+		}
+		if err := applySetting(name, nil, cfg[name]); err != nil {
+			return fmt.Errorf("%s: %s -- %v", conf.ConfigFile, name, err)
+		}
+	}
+	lastConfig.cfg = cfg
+	return nil
+}
+
+/*
+ *  Read the config file again and apply the settings changed since it
+ *  was last read. Reply one line per setting changed, TAB delimited:
+ *
+ *	set<TAB>name<TAB>old<TAB>new
+ *	restart<TAB>name<TAB>old<TAB>new
+ *
+ *  where restart means the change takes effect on the next start; it
+ *  is reported until then.
+ */
+func Reload(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("expects no argument for RELOAD")
+	}
+	if conf.ConfigFile == "" {
+		return "", errors.New("No config file")
+	}
+	cfg, err := conf.ReadConfig(conf.ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	if err = CheckConfig(cfg); err != nil {
+		return "", fmt.Errorf("%s: %v", conf.ConfigFile, err)
+	}
+
+	lastConfig.Lock()
+	defer lastConfig.Unlock()
+
+	// the settings in effect after the reload; those needing a restart
+	// stay as they were read at startup
+	old := lastConfig.cfg
+	next := make(conf.Config, len(cfg))
+	for name, values := range old {
+		next[name] = values
+	}
+
+	var reply strings.Builder
+	for _, name := range configNames(cfg) {
+		from, to := old.Value(name), cfg.Value(name)
+		if from == "" {
+			from = "-"
+		}
+		if configSettings[name].restart {
+			if from != to {
+				fmt.Fprintf(&reply, "restart\t%s\t%s\t%s\n", name, from, to)
+			}
+			continue
+		}
+		if from != to {
+			if err = applySetting(name, old[name], cfg[name]); err != nil {
+				break
+			}
+			fmt.Fprintf(&reply, "set\t%s\t%s\t%s\n", name, from, to)
+		}
+		next[name] = cfg[name]
+	}
+
+	// settings dropped from the file keep their values
+	for name := range old {
+		if _, ok := cfg[name]; ok {
+			continue
+		}
+		if configSettings[name].restart {
+			fmt.Fprintf(&reply, "restart\t%s\t%s\t-\n", name, old.Value(name))
+		} else if err == nil {
+			delete(next, name)
+		}
+	}
+
+	lastConfig.cfg = next
+	if err != nil {
+		return "", fmt.Errorf("%s: %v\n%s", conf.ConfigFile, err, reply.String())
+	}
+	if reply.Len() == 0 {
+		return "\n", nil
+	}
+	return reply.String(), nil
+}
@@ -0,0 +1,68 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"reflect"
+	"s3pool/conf"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	// the example in the doc of conf.Config
+	good := conf.Config{
+		"port":        {"7000"},
+		"devices":     {"/d1", "/d2"},
+		"dfs":         {"s3"},
+		"hwm":         {"85"},
+		"quota":       {"bucket1=10G"},
+		"retry_delay": {"1000"},
+	}
+	if err := CheckConfig(good); err != nil {
+		t.Errorf("CheckConfig(%v) = %v", good, err)
+	}
+
+	for _, cfg := range []conf.Config{
+		{"s3": {"true"}},
+		{"dfs": {"ftp"}},
+		{"port": {"x"}},
+		{"port": {"7000", "7001"}},
+		{"no_daemon": {"maybe"}},
+		{"devices": {""}},
+		{"quota": {"bucket1"}},
+		{"quota": {"bucket1=lots"}},
+		{"verify": {"maybe"}},
+		{"retry_delay": {"1", "2"}},
+		{"lwm": {"95"}},
+		{"hwm": {"60"}, "lwm": {"70"}},
+	} {
+		if err := CheckConfig(cfg); err == nil {
+			t.Errorf("CheckConfig(%v) did not fail", cfg)
+		}
+	}
+}
+
+func TestConfigNames(t *testing.T) {
+	save := conf.LWM
+	defer func() { conf.LWM = save }()
+	conf.LWM = 75
+
+	cfg := conf.Config{"hwm": {"60"}, "lwm": {"50"}, "verbose": {"1"}}
+	if got, want := configNames(cfg), []string{"lwm", "hwm", "verbose"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("configNames lowering lwm = %v, want %v", got, want)
+	}
+	cfg = conf.Config{"hwm": {"95"}, "lwm": {"80"}, "verbose": {"1"}}
+	if got, want := configNames(cfg), []string{"hwm", "lwm", "verbose"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("configNames raising lwm = %v, want %v", got, want)
+	}
+}
@@ -14,58 +14,27 @@ package op
 
 import (
 	"errors"
-	"s3pool/conf"
-	"strconv"
+	"fmt"
 	"strings"
 )
 
-func strtobool(s string) bool {
-	return s == "true" || s == "1" || s == "on"
-}
-
 func Set(args []string) (string, error) {
 	if len(args) != 2 {
 		return "", errors.New("expects 2 arguments for SET")
 	}
 	varname, varvalue := strings.ToLower(args[0]), strings.ToLower(args[1])
 
-	if varname == "verbose" {
-		i, err := strconv.Atoi(varvalue)
-		if err != nil {
-			return "", err
-		}
-		if i < 0 {
-			i = 0 // minimum
-		}
-		conf.VerboseLevel = i
-		return "\n", nil
+	if varname == "quota" || (varname == "refresh_interval" && strings.Contains(varvalue, "=")) {
+		// settings of one bucket are changed by SETB only
+		return "", fmt.Errorf("%s of a bucket is set by SETB bucket %s value", varname, varname)
 	}
 
-	if varname == "refresh_interval" {
-		i, err := strconv.Atoi(varvalue)
-		if err != nil {
-			return "", err
-		}
-		if i < 2 {
-			i = 2 // minimum
-		}
-		conf.RefreshInterval = i
-		conf.BucketmonChannel <- ""
-		return "\n", nil
+	t := findTunable(varname)
+	if t == nil {
+		return "", errors.New("Unknown var name")
 	}
-
-	if varname == "pull_concurrency" {
-		i, err := strconv.Atoi(varvalue)
-		if err != nil {
-			return "", err
-		}
-		if i < 5 {
-			i = 5 // minimum
-		}
-		conf.PullConcurrency = i
-		pullQueue.SetNWorker(i)
-		return "\n", nil
+	if err := t.setValue(varvalue); err != nil {
+		return "", fmt.Errorf("%s -- %v", varname, err)
 	}
-
-	return "", errors.New("Unknown var name")
+	return "\n", nil
 }
@@ -0,0 +1,60 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetBucketSettings(t *testing.T) {
+	for _, args := range [][]string{
+		{"quota", "b=10G"},
+		{"refresh_interval", "b=5"},
+	} {
+		_, err := Set(args)
+		if err == nil || !strings.Contains(err.Error(), "SETB") {
+			t.Errorf("Set(%v) = %v, want an error naming SETB", args, err)
+		}
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	if _, err := Set([]string{"nosuch", "1"}); err == nil {
+		t.Error("Set of an unknown name did not fail")
+	}
+
+	save, _ := Get([]string{"retry_delay"})
+	defer Set([]string{"retry_delay", strings.TrimSpace(save)})
+	if _, err := Set([]string{"RETRY_DELAY", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	// raised to the minimum
+	if v, err := Get([]string{"retry_delay"}); err != nil || v != "1\n" {
+		t.Errorf("Get(retry_delay) = %q, %v; want 1", v, err)
+	}
+
+	// every name SET takes is reported by GET and SHOW VARIABLES
+	show, err := Show([]string{"VARIABLES"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tu := range tunables {
+		if _, err := Get([]string{tu.name}); err != nil {
+			t.Errorf("Get(%s) failed -- %v", tu.name, err)
+		}
+		if !strings.Contains(show, "\n"+tu.name+"\t") && !strings.HasPrefix(show, tu.name+"\t") {
+			t.Errorf("SHOW VARIABLES does not list %s", tu.name)
+		}
+	}
+}
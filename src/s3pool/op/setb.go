@@ -0,0 +1,136 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/cache"
+	"s3pool/conf"
+	"strings"
+)
+
+/*
+ *  arg0: bucket name
+ *  arg1: setting name
+ *  arg2: value; empty to revert to the global setting
+ *
+ *  With the bucket name only, reply the settings of the bucket, one
+ *  "name value" per line.
+ */
+func SetB(args []string) (string, error) {
+	if len(args) == 1 {
+		bc := conf.Bucket(args[0])
+		var reply strings.Builder
+		for _, name := range conf.BucketSettingNames {
+			value, _ := bc.Get(name)
+			fmt.Fprintf(&reply, "%s %s\n", name, value)
+		}
+		return reply.String(), nil
+	}
+	if len(args) != 3 {
+		return "", errors.New("expects 1 or 3 arguments for SETB")
+	}
+	bucket, name, value := args[0], strings.ToLower(args[1]), args[2]
+
+	// apply the pins first; they can fail on the pin limit
+	old := conf.Bucket(bucket)
+	if name == "pin" {
+		if err := repin(bucket, old.Pin, strings.Fields(value)); err != nil {
+			return "", err
+		}
+	}
+
+	_, cur, err := conf.SetBucket(bucket, name, value)
+	if err != nil {
+		if name == "pin" {
+			repin(bucket, strings.Fields(value), old.Pin)
+		}
+		return "", err
+	}
+
+	switch name {
+	case "quota":
+		cache.SetQuota(bucket, cur.Quota)
+	case "refresh_interval":
+		conf.BucketmonChannel <- ""
+	}
+	return "\n", nil
+}
+
+func has(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Change the pins that the settings of bucket make from patterns from
+// to patterns to
+func repin(bucket string, from, to []string) error {
+	var pinned []string
+	for _, pat := range to {
+		if has(from, pat) || cache.HasPin(bucket, pat, true) {
+			continue
+		}
+		if _, _, err := cache.PinObjects(bucket, pat, true); err != nil {
+			for _, p := range pinned {
+				cache.UnpinObjects(bucket, p, true)
+			}
+			return err
+		}
+		pinned = append(pinned, pat)
+	}
+	for _, pat := range from {
+		if !has(to, pat) {
+			cache.UnpinObjects(bucket, pat, true)
+		}
+	}
+	return nil
+}
+
+// Apply the quotas and pins of the bucket settings to the cache. Call
+// after cache.Init.
+func InitBuckets() {
+	buckets := conf.Buckets()
+	for bucket, bc := range buckets {
+		if bc.Quota > 0 {
+			cache.SetQuota(bucket, bc.Quota)
+		}
+		repin(bucket, nil, bc.Pin)
+	}
+
+	// drop the pins saved for settings that are gone
+	for _, p := range cache.Pins() {
+		if p.Setb && !has(buckets[p.Bucket].Pin, p.Pattern) {
+			cache.UnpinObjects(p.Bucket, p.Pattern, true)
+		}
+	}
+}
+
+// Fill in the filespec and schema file of bucket when not given
+func bucketDefaults(bucket, filespec, schemafn string) (string, string, error) {
+	bc := conf.Bucket(bucket)
+	if filespec == "" {
+		filespec = bc.Filespec
+	}
+	if schemafn == "" {
+		schemafn = bc.Schema
+	}
+	if filespec == "" || schemafn == "" {
+		return "", "", fmt.Errorf("no filespec or schema given, and bucket %s has no default", bucket)
+	}
+	return filespec, schemafn, nil
+}
@@ -0,0 +1,58 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"os"
+	"s3pool/cache"
+	"s3pool/conf"
+	"testing"
+)
+
+func TestSetbPinRevert(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if _, err := SetB([]string{"pb", "pin", "dim/* lookup"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.PinObjects("pb", "dim/*", false); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.HasPin("pb", "dim/*", true) || !cache.HasPin("pb", "lookup", true) {
+		t.Fatalf("SETB made pins %+v", cache.Pins())
+	}
+
+	// dropping one pattern leaves the other
+	if _, err := SetB([]string{"pb", "pin", "dim/*"}); err != nil {
+		t.Fatal(err)
+	}
+	if cache.HasPin("pb", "lookup", true) || !cache.HasPin("pb", "dim/*", true) {
+		t.Errorf("pins after dropping lookup: %+v", cache.Pins())
+	}
+
+	// reverting to the global setting drops the pins of SETB only
+	if _, err := SetB([]string{"pb", "pin", ""}); err != nil {
+		t.Fatal(err)
+	}
+	if cache.HasPin("pb", "dim/*", true) || !cache.HasPin("pb", "dim/*", false) {
+		t.Errorf("pins after revert: %+v", cache.Pins())
+	}
+	if pin := conf.Bucket("pb").Pin; len(pin) != 0 {
+		t.Errorf("bucket setting is %v after revert", pin)
+	}
+	cache.UnpinObjects("pb", "dim/*", false)
+}
@@ -0,0 +1,81 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"context"
+	"errors"
+	"s3pool/conf"
+	"strconv"
+	"time"
+)
+
+// Requests do their work under workCtx, and background work (PREFETCH
+// and the refreshes of bucketmon) under bgCtx. On shutdown, bgCtx is
+// canceled at once and workCtx at the drain deadline, which kills the
+// backend commands still running.
+var workCtx, cancelWork = context.WithCancel(context.Background())
+var bgCtx, cancelBackground = context.WithCancel(workCtx)
+
+// Cancel the background work
+func StopBackground() {
+	cancelBackground()
+}
+
+// Wait up to timeout for the jobs queued and running to finish, then
+// cancel those left and give them a moment to clean up. Returns false
+// if the jobs had to be canceled.
+func Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pullQueue.Destroy()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	cancelWork()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+	return false
+}
+
+/*
+ *  arg0: optional seconds to drain; default conf.ShutdownTimeout
+ */
+func Shutdown(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("expects at most 1 argument for SHUTDOWN")
+	}
+	secs := conf.ShutdownTimeout
+	if len(args) == 1 {
+		i, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", err
+		}
+		if i < 0 {
+			i = 0
+		}
+		secs = i
+	}
+	select {
+	case conf.ShutdownChannel <- secs:
+	default:
+		return "", errors.New("Shutdown in progress")
+	}
+	return "\n", nil
+}
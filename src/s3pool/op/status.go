@@ -14,27 +14,111 @@ package op
 
 import (
 	"fmt"
+	"s3pool/cache"
 	"s3pool/conf"
+	"s3pool/jobqueue"
+	"s3pool/strlock"
+	"sort"
 	"strings"
+	"time"
 )
 
 func Status(_ []string) (string, error) {
 
 	var reply strings.Builder
 
+	fmt.Fprintf(&reply, "background_concurrency %v\n", conf.BackgroundConcurrency)
+	fmt.Fprintf(&reply, "cache_objects %v\n", cache.Count())
+	fmt.Fprintf(&reply, "catalog_wait %v\n", conf.CatalogWait)
 	fmt.Fprintf(&reply, "count_glob %v\n", conf.CountGlob)
+	fmt.Fprintf(&reply, "count_prefetch %v\n", conf.CountPrefetch)
 	fmt.Fprintf(&reply, "count_pull %v\n", conf.CountPull)
 	fmt.Fprintf(&reply, "count_pull_hit %v\n", conf.CountPullHit)
+	fmt.Fprintf(&reply, "count_pull_shared %v\n", conf.CountPullShared)
 	fmt.Fprintf(&reply, "count_push %v\n", conf.CountPush)
+	fmt.Fprintf(&reply, "count_quarantine %v\n", conf.CountQuarantine)
 	fmt.Fprintf(&reply, "count_refresh %v\n", conf.CountRefresh)
+	fmt.Fprintf(&reply, "count_retry %v\n", conf.CountRetry)
+	fmt.Fprintf(&reply, "evict_policy %v\n", conf.EvictPolicy)
+	fmt.Fprintf(&reply, "get_timeout %v\n", conf.GetTimeout)
+	fmt.Fprintf(&reply, "hwm %v\n", conf.HWM)
 	fmt.Fprintf(&reply, "is_master %v\n", conf.IsMaster)
+	held, waiting := 0, 0
+	for _, l := range strlock.Locks() {
+		held++
+		waiting += len(l.Waiters)
+	}
+	fmt.Fprintf(&reply, "list_timeout %v\n", conf.ListTimeout)
+	fmt.Fprintf(&reply, "lock_timeout %v\n", conf.LockTimeout)
+	fmt.Fprintf(&reply, "locks_held %v\n", held)
+	fmt.Fprintf(&reply, "locks_waiting %v\n", waiting)
+	fmt.Fprintf(&reply, "lwm %v\n", conf.LWM)
 	fmt.Fprintf(&reply, "master %v\n", conf.Master)
+	fmt.Fprintf(&reply, "pin_limit %v\n", conf.PinLimit)
+	for _, p := range cache.Pins() {
+		fmt.Fprintf(&reply, "pin %v %v\n", p.Bucket, p.Pattern)
+	}
+	fmt.Fprintf(&reply, "pinned_bytes %v\n", cache.PinnedBytes())
 	fmt.Fprintf(&reply, "pull_concurrency %v\n", conf.PullConcurrency)
+	for pri := 0; pri < jobqueue.NPRIORITY; pri++ {
+		// jobs waiting and running
+		name := "pull_queue_" + jobqueue.PriorityName(pri)
+		fmt.Fprintf(&reply, "%s %v\n", name, pullQueue.Len(pri))
+		fmt.Fprintf(&reply, "%s_running %v\n", name, pullQueue.Running(pri))
+	}
+	fmt.Fprintf(&reply, "put_timeout %v\n", conf.PutTimeout)
+	fmt.Fprintf(&reply, "refresh_concurrency %v\n", conf.RefreshConcurrency)
 	fmt.Fprintf(&reply, "refresh_interval %v\n", conf.RefreshInterval)
+	stats := RefreshStats()
+	bkts := make([]string, 0, len(stats))
+	for bkt := range stats {
+		bkts = append(bkts, bkt)
+	}
+	for bkt, bc := range conf.Buckets() {
+		if _, ok := stats[bkt]; !ok && bc.RefreshInterval > 0 {
+			bkts = append(bkts, bkt)
+		}
+	}
+	sort.Strings(bkts)
+	for _, bkt := range bkts {
+		// bucket, interval, last success, last failure, keys, ms taken,
+		// last error
+		st := stats[bkt]
+		fmt.Fprintf(&reply, "refresh %v %v %v %v %v %v %q\n", bkt, conf.BucketRefreshInterval(bkt),
+			timeOrDash(st.LastSuccess), timeOrDash(st.LastFailure), st.Keys,
+			int64(st.Elapsed/time.Millisecond), st.LastError)
+	}
+	fmt.Fprintf(&reply, "retry_attempts %v\n", conf.RetryAttempts)
+	fmt.Fprintf(&reply, "retry_delay %v\n", conf.RetryDelay)
 	fmt.Fprintf(&reply, "revision %v\n", conf.Revision)
 	fmt.Fprintf(&reply, "standby %v\n", conf.Standby)
 	fmt.Fprintf(&reply, "up_since %v\n", conf.UpSince)
 	fmt.Fprintf(&reply, "verbose %v\n", conf.VerboseLevel)
+	fmt.Fprintf(&reply, "writeback_pending %v\n", WritebackPending())
+	fmt.Fprintf(&reply, "xrgdiv_timeout %v\n", conf.XrgdivTimeout)
 
 	return reply.String(), nil
 }
+
+// Return the quotas as lines of bucket, quota and bytes cached, TAB
+// delimited
+func quotaList() string {
+	quotas := cache.Quotas()
+	bkts := make([]string, 0, len(quotas))
+	for bkt := range quotas {
+		bkts = append(bkts, bkt)
+	}
+	sort.Strings(bkts)
+	var reply strings.Builder
+	for _, bkt := range bkts {
+		fmt.Fprintf(&reply, "%s\t%d\t%d\n", bkt, quotas[bkt], cache.BucketUsage(bkt))
+	}
+	return reply.String()
+}
+
+func timeOrDash(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
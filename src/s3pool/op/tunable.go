@@ -0,0 +1,308 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"errors"
+	"fmt"
+	"s3pool/cache"
+	"s3pool/conf"
+	"s3pool/jobqueue"
+	"strconv"
+	"strings"
+)
+
+// A setting that can be read by GET and changed by SET at runtime. To
+// add one, add it to tunables; SET, GET, SHOW VARIABLES and the config
+// file pick it up from there.
+type tunable struct {
+	name    string
+	kind    string // int, size or enum
+	min     int64  // bounds of int and size
+	max     int64  // 0 for no upper bound
+	clamp   bool   // move a value out of bounds into bounds, or reject it
+	desc    string
+	intp    *int                 // variable of int
+	sizep   *int64               // variable of size
+	choices func() []string      // values of enum
+	get     func() string        // value of enum
+	set     func(s string) error // change value of enum
+	check   func(n int64) error  // additional check of int before a change
+	changed func()               // called after a change
+}
+
+var tunables = []*tunable{
+	{name: "background_concurrency", kind: "int", min: 1, clamp: true,
+		intp: &conf.BackgroundConcurrency,
+		desc: "max workers on low priority jobs",
+		changed: func() {
+			pullQueue.SetLimit(jobqueue.LOW, conf.BackgroundConcurrency)
+		}},
+	{name: "catalog_wait", kind: "int", min: 1, clamp: true,
+		intp: &conf.CatalogWait,
+		desc: "seconds a request waits for the listing of a bucket"},
+	{name: "evict_policy", kind: "enum",
+		choices: cache.Policies,
+		get:     func() string { return conf.EvictPolicy },
+		set:     cache.SetPolicy,
+		desc:    "order of eviction by the disk monitor"},
+	{name: "get_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.GetTimeout,
+		desc: "seconds a download may take; 0 for no limit"},
+	{name: "hwm", kind: "int", min: 1, max: 99,
+		intp: &conf.HWM,
+		desc: "start eviction when a device is this % full",
+		check: func(n int64) error {
+			if conf.LWM >= int(n) {
+				return errors.New("lwm must be less than hwm")
+			}
+			return nil
+		}},
+	{name: "list_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.ListTimeout,
+		desc: "seconds a listing may take; 0 for no limit"},
+	{name: "local_symlinks", kind: "enum",
+		choices: func() []string { return []string{"follow", "skip"} },
+		get:     func() string { return conf.LocalSymlinks },
+		set: func(s string) error {
+			conf.LocalSymlinks = s
+			return nil
+		},
+		desc: "follow or skip symbolic links when listing a local bucket"},
+	{name: "lock_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.LockTimeout,
+		desc: "seconds a request waits for a lock; 0 to wait forever"},
+	{name: "lwm", kind: "int", min: 1, max: 99,
+		intp: &conf.LWM,
+		desc: "evict until a device is this % full",
+		check: func(n int64) error {
+			if int(n) >= conf.HWM {
+				return errors.New("lwm must be less than hwm")
+			}
+			return nil
+		}},
+	{name: "multipart_concurrency", kind: "int", min: 1, clamp: true,
+		intp: &conf.MultipartConcurrency,
+		desc: "parts of a push to s3 uploaded at once"},
+	{name: "multipart_size", kind: "size", min: 5 << 20, max: 5 << 30, clamp: true,
+		sizep: &conf.MultipartSize,
+		desc:  "bytes in a part of a multipart push to s3"},
+	{name: "multipart_threshold", kind: "size", min: 5 << 20, clamp: true,
+		sizep: &conf.MultipartThreshold,
+		desc:  "push files of at least this size to s3 in parts"},
+	{name: "pin_limit", kind: "size", min: 0,
+		sizep: &conf.PinLimit,
+		desc:  "max bytes of pinned objects; 0 for no limit"},
+	{name: "pull_concurrency", kind: "int", min: 5, clamp: true,
+		intp: &conf.PullConcurrency,
+		desc: "workers downloading objects",
+		changed: func() {
+			pullQueue.SetNWorker(conf.PullConcurrency)
+		}},
+	{name: "push_mode", kind: "enum",
+		choices: func() []string { return []string{"sync", "writeback"} },
+		get:     func() string { return conf.PushMode },
+		set: func(s string) error {
+			conf.PushMode = s
+			return nil
+		},
+		desc: "upload before PUSH replies, or after in the background"},
+	{name: "put_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.PutTimeout,
+		desc: "seconds an upload may take; 0 for no limit"},
+	{name: "refresh_concurrency", kind: "int", min: 1, clamp: true,
+		intp: &conf.RefreshConcurrency,
+		desc: "max bucket refreshes running"},
+	{name: "refresh_interval", kind: "int", min: 2, clamp: true,
+		intp: &conf.RefreshInterval,
+		desc: "minutes between refreshes of a bucket",
+		changed: func() {
+			conf.BucketmonChannel <- ""
+		}},
+	{name: "retry_attempts", kind: "int", min: 1, clamp: true,
+		intp: &conf.RetryAttempts,
+		desc: "max tries of a backend call; 1 for no retry"},
+	{name: "retry_delay", kind: "int", min: 1, clamp: true,
+		intp: &conf.RetryDelay,
+		desc: "ms before the first retry of a backend call"},
+	{name: "shutdown_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.ShutdownTimeout,
+		desc: "seconds to drain requests and jobs on shutdown"},
+	{name: "verbose", kind: "int", min: 0, clamp: true,
+		intp: &conf.VerboseLevel,
+		desc: "level of logging"},
+	{name: "verify", kind: "enum",
+		choices: func() []string { return []string{"off", "on"} },
+		get: func() string {
+			if conf.Verify {
+				return "on"
+			}
+			return "off"
+		},
+		set: func(s string) error {
+			conf.Verify = s == "on"
+			return nil
+		},
+		desc: "check downloads against the checksum of the backend"},
+	{name: "xrgdiv_timeout", kind: "int", min: 0, clamp: true,
+		intp: &conf.XrgdivTimeout,
+		desc: "seconds a conversion may take; 0 for no limit"},
+}
+
+func findTunable(name string) *tunable {
+	for _, t := range tunables {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *tunable) value() string {
+	switch {
+	case t.intp != nil:
+		return strconv.Itoa(*t.intp)
+	case t.sizep != nil:
+		return strconv.FormatInt(*t.sizep, 10)
+	}
+	return t.get()
+}
+
+// Parse value into a number in bounds. An enum is only checked.
+func (t *tunable) parse(value string) (n int64, err error) {
+	switch t.kind {
+	case "enum":
+		for _, c := range t.choices() {
+			if c == value {
+				return 0, nil
+			}
+		}
+		return 0, fmt.Errorf("expects one of %s", strings.Join(t.choices(), ", "))
+	case "size":
+		n, err = conf.ParseSize(value)
+	default:
+		n, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if n < t.min || (t.max > 0 && n > t.max) {
+		if !t.clamp {
+			if t.max > 0 {
+				return 0, fmt.Errorf("expects a value between %d and %d", t.min, t.max)
+			}
+			return 0, fmt.Errorf("expects a value of at least %d", t.min)
+		}
+		if n < t.min {
+			n = t.min
+		} else {
+			n = t.max
+		}
+	}
+	return n, nil
+}
+
+func (t *tunable) setValue(value string) error {
+	n, err := t.parse(value)
+	if err != nil {
+		return err
+	}
+	if t.check != nil {
+		if err = t.check(n); err != nil {
+			return err
+		}
+	}
+	switch {
+	case t.intp != nil:
+		*t.intp = int(n)
+	case t.sizep != nil:
+		*t.sizep = n
+	default:
+		if err = t.set(value); err != nil {
+			return err
+		}
+	}
+	if t.changed != nil {
+		t.changed()
+	}
+	return nil
+}
+
+/*
+ *  arg0: name of setting
+ *
+ *  Reply the current value of the setting.
+ */
+func Get(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expects 1 argument for GET")
+	}
+	t := findTunable(strings.ToLower(args[0]))
+	if t == nil {
+		return "", errors.New("Unknown var name")
+	}
+	return t.value() + "\n", nil
+}
+
+/*
+ *  SHOW VARIABLES
+ *
+ *  Reply one line per setting, TAB delimited:
+ *
+ *	name<TAB>type<TAB>min<TAB>max<TAB>value<TAB>description
+ *
+ *  The type of an enum is its values delimited by '|'. Bounds that do
+ *  not apply are '-'.
+ *
+ *  SHOW WRITEBACK
+ *
+ *  Reply one line per upload pending, TAB delimited:
+ *
+ *	bucket<TAB>key<TAB>tries<TAB>time of the PUSH
+ *
+ *  SHOW QUOTAS
+ *
+ *  Reply one line per bucket quota, TAB delimited:
+ *
+ *	bucket<TAB>quota<TAB>bytes cached
+ */
+func Show(args []string) (string, error) {
+	lists := map[string]func() string{
+		"WRITEBACK": writebackQueue,
+		"QUOTAS":    quotaList,
+	}
+	if len(args) == 1 && lists[strings.ToUpper(args[0])] != nil {
+		if l := lists[strings.ToUpper(args[0])](); l != "" {
+			return l, nil
+		}
+		return "\n", nil
+	}
+	if len(args) != 1 || strings.ToUpper(args[0]) != "VARIABLES" {
+		return "", errors.New("expects VARIABLES, WRITEBACK or QUOTAS for SHOW")
+	}
+	var reply strings.Builder
+	for _, t := range tunables {
+		kind, min, max := t.kind, "-", "-"
+		if t.kind == "enum" {
+			kind = strings.Join(t.choices(), "|")
+		} else {
+			min = strconv.FormatInt(t.min, 10)
+			if t.max > 0 {
+				max = strconv.FormatInt(t.max, 10)
+			}
+		}
+		fmt.Fprintf(&reply, "%s\t%s\t%s\t%s\t%s\t%s\n", t.name, kind, min, max, t.value(), t.desc)
+	}
+	return reply.String(), nil
+}
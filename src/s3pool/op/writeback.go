@@ -0,0 +1,406 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/gcs"
+	"s3pool/hdfs"
+	"s3pool/hdfs2x"
+	"s3pool/journal"
+	"s3pool/s3"
+	"s3pool/strlock"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In write-back mode (SET push_mode writeback), PUSH copies the file to
+// WRITEBACKDIR, records it in the journal there and replies at once.
+// The copy is linked into data/ as the cached object of the key, which
+// PULL serves and the disk monitor does not evict until the uploader
+// has pushed it to the backend. The uploader works through the journal
+// in order, one upload at a time, and tries a failed upload again
+// after a delay that doubles up to WRITEBACKMAXDELAY. A PUSH of a key
+// that is waiting for its upload is queued after it in any mode, and
+// supersedes it. The journal is replayed on startup, so that no PUSH
+// is lost to a restart. Local buckets are always pushed at once.
+
+const WRITEBACKDIR = "writeback"
+const WRITEBACKMAXDELAY = 10 * time.Minute
+
+type wbEntry struct {
+	journal.Entry
+	tries int
+	next  time.Time // of the next try
+}
+
+var wb struct {
+	mux     sync.Mutex
+	j       *journal.Journal
+	queue   []*wbEntry     // in order of Seq
+	pending map[string]int // # entries of each bucket:key in queue
+	wake    chan struct{}
+}
+
+// Replay the journal and start the uploader. Must be called after
+// cache.Init.
+func InitWriteback() error {
+	if err := os.MkdirAll(WRITEBACKDIR, 0755); err != nil {
+		return err
+	}
+	j, todo, err := journal.Open(filepath.Join(WRITEBACKDIR, "journal"))
+	if err != nil {
+		return err
+	}
+	wb.j = j
+	wb.pending = make(map[string]int)
+	wb.wake = make(chan struct{}, 1)
+
+	staged := make(map[string]bool)
+	for i, e := range todo {
+		if _, err := os.Stat(e.Path); err != nil {
+			log.Printf("writeback: drop %s:%s -- %v\n", e.Bucket, e.Key, err)
+			j.Done(e.Seq)
+			continue
+		}
+		// the last copy of a key should be its cached object
+		last := true
+		for _, later := range todo[i+1:] {
+			last = last && later.Bucket+":"+later.Key != e.Bucket+":"+e.Key
+		}
+		if last && !installed(e.Bucket, e.Key, e.Path) {
+			if err := install(e.Bucket, e.Key, e.Path); err != nil {
+				log.Printf("writeback: cannot cache %s:%s -- %v\n", e.Bucket, e.Key, err)
+			}
+		}
+		staged[e.Path] = true
+		enqueue(e)
+	}
+
+	// remove the copies of PUSHes that died before they were recorded
+	names, _ := filepath.Glob(filepath.Join(WRITEBACKDIR, "wb_*"))
+	for _, name := range names {
+		if path, err := filepath.Abs(name); err == nil && !staged[path] {
+			os.Remove(path)
+		}
+	}
+	if len(wb.queue) > 0 {
+		log.Printf("writeback: %d uploads pending\n", len(wb.queue))
+	}
+
+	go uploader(workCtx)
+	return nil
+}
+
+// Return the number of uploads pending
+func WritebackPending() int {
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	return len(wb.queue)
+}
+
+// Return the keys of bucket waiting for their upload that pass filter
+func writebackKeys(bucket string, filter func(string) bool) (keys []string) {
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	seen := make(map[string]bool)
+	for _, e := range wb.queue {
+		if e.Bucket == bucket && !seen[e.Key] && filter(e.Key) {
+			seen[e.Key] = true
+			keys = append(keys, e.Key)
+		}
+	}
+	return
+}
+
+// Return true if bucket:key waits for its upload. Its cached object
+// is then the file pushed, which must not be fetched again.
+func writebackPending(bucket, key string) bool {
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	return wb.pending[bucket+":"+key] > 0
+}
+
+func enqueue(e journal.Entry) {
+	wb.mux.Lock()
+	wb.queue = append(wb.queue, &wbEntry{Entry: e})
+	wb.pending[e.Bucket+":"+e.Key]++
+	wb.mux.Unlock()
+	cache.Hold(e.Bucket, e.Key)
+
+	select {
+	case wb.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PUSH fname to bucket:key in write-back mode
+func pushWriteback(ctx context.Context, bucket, key, fname string) error {
+	if conf.Verbose(1) {
+		log.Println("writeback push", bucket, key, fname)
+	}
+
+	// lock to serialize on (bucket,key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	staged, err := stage(fname)
+	if err != nil {
+		return err
+	}
+	if err = install(bucket, key, staged); err != nil {
+		cache.Remove(bucket, key)
+		os.Remove(staged)
+		return err
+	}
+	e, err := wb.j.Add(bucket, key, staged)
+	if err != nil {
+		cache.Remove(bucket, key)
+		os.Remove(staged)
+		return err
+	}
+	enqueue(e)
+
+	// the catalog gets the key with its etag once it is uploaded;
+	// until then GLOB finds it with writebackKeys
+	return nil
+}
+
+// Copy fname to WRITEBACKDIR and sync it to disk. Returns the path of
+// the copy.
+func stage(fname string) (string, error) {
+	in, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(WRITEBACKDIR, "wb_")
+	if err != nil {
+		return "", fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("Cannot copy %s -- %v", fname, err)
+	}
+	return filepath.Abs(out.Name())
+}
+
+// Return true if fname is a copy in WRITEBACKDIR
+func isStaged(fname string) bool {
+	dir, err := filepath.Abs(WRITEBACKDIR)
+	return err == nil && strings.HasPrefix(fname, dir+"/")
+}
+
+func dataPath(bucket, key string) (string, error) {
+	return filepath.Abs(fmt.Sprintf("data/%s/%s", bucket, key))
+}
+
+// Return true if the cached object of bucket:key is the copy at staged
+func installed(bucket, key, staged string) bool {
+	path, err := dataPath(bucket, key)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	sfi, serr := os.Stat(staged)
+	return err == nil && serr == nil && os.SameFile(fi, sfi)
+}
+
+// Replace the cached object of bucket:key with the copy at staged.
+// Caller should hold the strlock on "bucket:key".
+func install(bucket, key, staged string) error {
+	if err := cache.Remove(bucket, key); err != nil {
+		return err
+	}
+	path, err := dataPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = os.Link(staged, path); err != nil {
+		return err
+	}
+
+	// the meta file tells that the object was pushed
+	meta := []byte("writeback " + staged + "\n")
+	if conf.BucketDfsMode(bucket) == conf.DFS_S3 {
+		meta, _ = json.MarshalIndent(map[string]string{"ETag": "\"writeback\""}, "", "    ")
+	}
+	return ioutil.WriteFile(path+"__meta__", meta, 0644)
+}
+
+// Upload the entries of the journal until ctx is canceled
+func uploader(ctx context.Context) {
+	for {
+		e, wait := nextUpload()
+		if e == nil {
+			select {
+			case <-wb.wake:
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		etag, meta, err := upload(ctx, e)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			wb.mux.Lock()
+			e.tries++
+			delay := 30 * time.Second << uint(e.tries-1)
+			if delay > WRITEBACKMAXDELAY || delay <= 0 {
+				delay = WRITEBACKMAXDELAY
+			}
+			e.next = time.Now().Add(delay)
+			wb.mux.Unlock()
+			log.Printf("writeback: upload of %s:%s failed, try again in %v -- %v\n", e.Bucket, e.Key, delay, err)
+			continue
+		}
+		finish(ctx, e, etag, meta)
+	}
+}
+
+// Return the first entry in the queue that is due, dropping the
+// entries superseded by a later PUSH of their key. If there is none,
+// return the time to wait for one.
+func nextUpload() (*wbEntry, time.Duration) {
+	var superseded []*wbEntry
+	defer func() {
+		for _, e := range superseded {
+			finish(workCtx, e, "", nil)
+		}
+	}()
+
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	wait := WRITEBACKMAXDELAY
+	last := make(map[string]*wbEntry)
+	for _, e := range wb.queue {
+		last[e.Bucket+":"+e.Key] = e
+	}
+	now := time.Now()
+	for _, e := range wb.queue {
+		if last[e.Bucket+":"+e.Key] != e {
+			superseded = append(superseded, e)
+			continue
+		}
+		if !e.next.After(now) {
+			return e, 0
+		}
+		if d := e.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// Upload the copy of e to the backend of its bucket. Returns the etag
+// of the object uploaded and the content of its meta file.
+func upload(ctx context.Context, e *wbEntry) (string, []byte, error) {
+	if conf.Verbose(1) {
+		log.Println("writeback upload", e.Bucket, e.Key)
+	}
+	switch conf.BucketDfsMode(e.Bucket) {
+	case conf.DFS_HDFS:
+		return hdfs.Upload(ctx, e.Bucket, e.Key, e.Path)
+	case conf.DFS_HDFS2X:
+		return hdfs2x.Upload(ctx, e.Bucket, e.Key, e.Path)
+	case conf.DFS_GCS:
+		return gcs.Upload(ctx, e.Bucket, e.Key, e.Path)
+	case conf.DFS_LOCAL:
+		return "", nil, fmt.Errorf("write-back is not supported for local buckets")
+	}
+	return s3.Upload(ctx, e.Bucket, e.Key, e.Path)
+}
+
+// Mark e done in the journal and drop it from the queue. etag and meta
+// are those of the object uploaded, or empty if e was superseded. Once
+// the last entry of the key is uploaded, its copy is kept as the cached
+// object with the meta file of the upload, as after a PUSH in sync mode.
+func finish(ctx context.Context, e *wbEntry, etag string, meta []byte) {
+	lockname, err := strlock.LockContext(strlock.WithOwner(ctx, "PUSH writeback"), e.Bucket+":"+e.Key)
+	if err != nil {
+		return
+	}
+	defer strlock.Unlock(lockname)
+
+	if err = wb.j.Done(e.Seq); err != nil {
+		log.Printf("writeback: %v\n", err)
+	}
+	name := e.Bucket + ":" + e.Key
+	wb.mux.Lock()
+	for i, q := range wb.queue {
+		if q == e {
+			wb.queue = append(wb.queue[:i], wb.queue[i+1:]...)
+			break
+		}
+	}
+	wb.pending[name]--
+	done := wb.pending[name] == 0
+	if done {
+		delete(wb.pending, name)
+	}
+	wb.mux.Unlock()
+	cache.Release(e.Bucket, e.Key)
+
+	if etag != "" {
+		log.Printf("writeback: uploaded %s:%s\n", e.Bucket, e.Key)
+	}
+	if done && etag != "" {
+		if err = cache.Keep(e.Bucket, e.Key, e.Path, meta); err != nil {
+			log.Printf("writeback: cannot cache %s:%s -- %v\n", e.Bucket, e.Key, err)
+		}
+		cat.Upsert(e.Bucket, e.Key, etag)
+	}
+	os.Remove(e.Path)
+}
+
+// Return the entries of the queue as lines of bucket, key, tries and
+// the time the PUSH was made, TAB delimited
+func writebackQueue() string {
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	var reply strings.Builder
+	for _, e := range wb.queue {
+		fmt.Fprintf(&reply, "%s\t%s\t%d\t%s\n", e.Bucket, e.Key, e.tries,
+			time.Unix(e.Time, 0).Format(time.RFC3339))
+	}
+	return reply.String()
+}
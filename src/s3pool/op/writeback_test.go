@@ -0,0 +1,82 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package op
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/journal"
+	"testing"
+)
+
+// Set up the write-back queue in a temp dir, without the uploader
+func initWriteback(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	os.MkdirAll(WRITEBACKDIR, 0755)
+	j, _, err := journal.Open(filepath.Join(WRITEBACKDIR, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb.j = j
+	wb.queue = nil
+	wb.pending = make(map[string]int)
+	wb.wake = make(chan struct{}, 1)
+
+	save, saveMode := cat.UseS3Meta, conf.DfsMode
+	cat.UseS3Meta, conf.DfsMode = false, conf.DFS_S3
+	t.Cleanup(func() { cat.UseS3Meta, conf.DfsMode = save, saveMode })
+}
+
+func TestPushWriteback(t *testing.T) {
+	initWriteback(t)
+	cat.Store("b", []string{"a.csv", "z.csv"}, []string{"e1", "e2"}, nil)
+
+	fname := filepath.Join(t.TempDir(), "m.csv")
+	ioutil.WriteFile(fname, []byte("1,2,3\n"), 0644)
+	if err := pushWriteback(context.Background(), "b", "m.csv", fname); err != nil {
+		t.Fatal(err)
+	}
+
+	// no etag enters the catalog before the upload
+	if etag := cat.Find("b", "m.csv"); etag != "" {
+		t.Errorf("catalog has etag %q before the upload", etag)
+	}
+	if !writebackPending("b", "m.csv") {
+		t.Error("push is not pending")
+	}
+
+	// GLOB finds the key pushed all the same
+	keys, err := globKeys("b", "*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.csv", "m.csv", "z.csv"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("globKeys = %v, want %v", keys, want)
+	}
+	if keys, _ := globKeys("b", "a*"); !reflect.DeepEqual(keys, []string{"a.csv"}) {
+		t.Errorf("globKeys = %v, want [a.csv]", keys)
+	}
+}
@@ -47,6 +47,13 @@ func Write() {
 	ioutil.WriteFile(pidFname, byt, 0644)
 }
 
+// Remove the pidfile if it is ours
+func Remove() {
+	if Read() == os.Getpid() {
+		os.Remove(pidFname)
+	}
+}
+
 func PsCommand() string {
 	pid := Read()
 	if pid == 0 {
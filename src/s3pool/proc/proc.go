@@ -0,0 +1,79 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package proc
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Subprocesses such as aws, gohdfs, hadoop and xrgdiv run in a process
+// group of their own, so that when their context is done the whole
+// group is killed, including the children they started.
+
+// How long Wait waits for the pipes of a killed group to close
+const WAITDELAY = 10 * time.Second
+
+type TimeoutError struct {
+	Op       string
+	Canceled bool // canceled rather than timed out
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Canceled {
+		return e.Op + " canceled"
+	}
+	return e.Op + " timed out"
+}
+
+func IsTimeout(err error) bool {
+	var te *TimeoutError
+	return errors.As(err, &te)
+}
+
+// Return a context that is done after secs seconds; secs <= 0 means no
+// timeout
+func WithTimeout(ctx context.Context, secs int) (context.Context, context.CancelFunc) {
+	if secs <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+}
+
+// Like exec.CommandContext, but kills the process group of the command
+// when ctx is done
+func Command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = WAITDELAY
+	return cmd
+}
+
+// Return a TimeoutError for op if ctx is done, else nil. Callers use it
+// on a failed command to tell a timeout from other failures.
+func Err(ctx context.Context, op string) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.Canceled:
+		return &TimeoutError{op, true}
+	default:
+		return &TimeoutError{op, false}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"s3pool/conf"
+	"s3pool/proc"
+	"strings"
+	"time"
+)
+
+// Backend calls that fail for a transient reason -- throttling, a 5xx
+// from the service, a dropped connection -- are tried again up to
+// conf.RetryAttempts times in all, sleeping a jittered, exponentially
+// growing delay between attempts. Other failures, and timeouts, are
+// returned at once.
+
+// the longest delay between attempts
+const MAXDELAY = 30 * time.Second
+
+// substrings, in lower case, of the errors worth another try
+var transient = []string{
+	// throttling
+	"throttl", "slowdown", "slow down", "requestlimitexceeded",
+	"toomanyrequests", "(429)", "error 429",
+	// server errors
+	"internalerror", "internal error", "serviceunavailable",
+	"service unavailable", "(500)", "(502)", "(503)", "(504)",
+	"error 500", "error 502", "error 503", "error 504",
+	"retriableexception", "standbyexception",
+	// network
+	"connection reset", "connection refused", "broken pipe",
+	"could not connect to the endpoint", "connection was closed",
+	"connectexception", "sockettimeoutexception", "i/o timeout",
+	"read timeout", "temporary failure in name resolution",
+	"unexpected eof",
+	// corrupted in transit
+	"checksum mismatch",
+}
+
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string { return e.err.Error() }
+func (e *stopError) Unwrap() error { return e.err }
+
+// Wrap err so that Do returns it without another try
+func Stop(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stopError{err}
+}
+
+// Is err worth another try?
+func Retryable(err error) bool {
+	var se *stopError
+	if err == nil || proc.IsTimeout(err) || errors.As(err, &se) {
+		return false
+	}
+	s := strings.ToLower(err.Error())
+	for _, t := range transient {
+		if strings.Contains(s, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the delay before try number attempt+1, counting from 0
+func Backoff(attempt int) time.Duration {
+	d := time.Duration(conf.RetryDelay) * time.Millisecond
+	for i := 0; i < attempt && d < MAXDELAY; i++ {
+		d *= 2
+	}
+	if d > MAXDELAY {
+		d = MAXDELAY
+	}
+	// somewhere between d/2 and 3d/2, so that callers that failed
+	// together do not come back together
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// Call fn until it succeeds, fails for a reason that is not transient,
+// runs out of attempts or ctx is done. Returns the last error.
+func Do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt+1 >= conf.RetryAttempts || !Retryable(err) {
+			var se *stopError
+			if errors.As(err, &se) {
+				return se.err
+			}
+			return err
+		}
+
+		delay := Backoff(attempt)
+		log.Printf("%s failed, retry in %v -- %v\n", op, delay.Round(time.Millisecond), err)
+		conf.CountRetry++
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return proc.Err(ctx, op)
+		}
+	}
+}
+
+// Call list with retries as Do does, passing records on to notify. A
+// listing that fails after it passed on some records is not tried
+// again, so that notify never sees a record twice.
+func DoList(ctx context.Context, op string, list func(notify func(key, etag string)) error,
+	notify func(key, etag string)) error {
+	n := 0
+	return Do(ctx, op, func() error {
+		err := list(func(key, etag string) {
+			n++
+			notify(key, etag)
+		})
+		if err != nil && n > 0 {
+			return Stop(err)
+		}
+		return err
+	})
+}
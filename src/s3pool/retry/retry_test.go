@@ -0,0 +1,130 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package retry
+
+import (
+	"context"
+	"errors"
+	"s3pool/conf"
+	"s3pool/proc"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("An error occurred (SlowDown) when calling the GetObject operation"), true},
+		{errors.New("An error occurred (503) when calling the HeadObject operation"), true},
+		{errors.New("read tcp 10.0.0.1:443: connection reset by peer"), true},
+		{errors.New("java.net.SocketTimeoutException: 60000 millis timeout"), true},
+		{errors.New("An error occurred (404) when calling the HeadObject operation: Not Found"), false},
+		{errors.New("An error occurred (AccessDenied) when calling the GetObject operation"), false},
+		{Stop(errors.New("connection reset by peer")), false},
+		{&proc.TimeoutError{}, false},
+	} {
+		if got := Retryable(c.err); got != c.want {
+			t.Errorf("Retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	save := conf.RetryDelay
+	conf.RetryDelay = 1000
+	defer func() { conf.RetryDelay = save }()
+
+	for attempt, d := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, MAXDELAY, MAXDELAY, MAXDELAY,
+	} {
+		for i := 0; i < 20; i++ {
+			got := Backoff(attempt)
+			if got < d/2 || got > d*3/2 {
+				t.Fatalf("Backoff(%d) = %v, want %v to %v", attempt, got, d/2, d*3/2)
+			}
+		}
+	}
+}
+
+// Set the retry tunables for a fast test
+func fast(t *testing.T, attempts int) {
+	saveAttempts, saveDelay := conf.RetryAttempts, conf.RetryDelay
+	conf.RetryAttempts, conf.RetryDelay = attempts, 1
+	t.Cleanup(func() { conf.RetryAttempts, conf.RetryDelay = saveAttempts, saveDelay })
+}
+
+func TestDo(t *testing.T) {
+	fast(t, 3)
+	transientErr := errors.New("service unavailable")
+
+	n := 0
+	err := Do(context.Background(), "test", func() error {
+		n++
+		if n < 3 {
+			return transientErr
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Do returned %v after %d calls, want nil after 3", err, n)
+	}
+
+	n = 0
+	err = Do(context.Background(), "test", func() error { n++; return transientErr })
+	if err != transientErr || n != 3 {
+		t.Errorf("Do returned %v after %d calls, want %v after 3", err, n, transientErr)
+	}
+
+	n = 0
+	permanent := errors.New("no such key")
+	err = Do(context.Background(), "test", func() error { n++; return permanent })
+	if err != permanent || n != 1 {
+		t.Errorf("Do returned %v after %d calls, want %v after 1", err, n, permanent)
+	}
+
+	n = 0
+	err = Do(context.Background(), "test", func() error { n++; return Stop(transientErr) })
+	if err != transientErr || n != 1 {
+		t.Errorf("Do returned %v after %d calls, want the unwrapped error after 1", err, n)
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	fast(t, 10)
+	conf.RetryDelay = 10000
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := Do(ctx, "test", func() error { return errors.New("connection refused") })
+	if !proc.IsTimeout(err) {
+		t.Errorf("Do returned %v, want a timeout error", err)
+	}
+}
+
+func TestDoList(t *testing.T) {
+	fast(t, 3)
+	n := 0
+	var seen []string
+	err := DoList(context.Background(), "test", func(notify func(key, etag string)) error {
+		n++
+		notify("k1", "e1")
+		return errors.New("connection reset by peer")
+	}, func(key, etag string) { seen = append(seen, key) })
+	if err == nil || n != 1 || len(seen) != 1 {
+		t.Errorf("DoList returned %v after %d calls and %d records, want an error after 1 and 1",
+			err, n, len(seen))
+	}
+}
@@ -14,13 +14,15 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"strings"
 )
 
@@ -29,7 +31,7 @@ import (
 //
 //   aws s3api get-object --bucket BUCKET --key KEY --if-none-match ETAG tmppath
 //
-func GetObject(bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
+func GetObject(ctx context.Context, bucket string, key string, force bool) (retpath string, metapath string, hit bool, err error) {
 	if conf.Verbose(1) {
 		log.Println("s3 get-objects", bucket, key)
 	}
@@ -80,15 +82,38 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	defer os.Remove(tmppath)
 
 	// Run the command
-	cmd := exec.Command("aws", "s3api", "get-object",
-		"--bucket", bucket,
-		"--key", key,
-		"--if-none-match", etag,
-		tmppath)
+	ctx, cancel := proc.WithTimeout(ctx, conf.GetTimeout)
+	defer cancel()
 	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-	if err = cmd.Run(); err != nil {
+	var digest string
+	err = retry.Do(ctx, "aws s3api get-object", func() error {
+		outbuf.Reset()
+		errbuf.Reset()
+		args := []string{"s3api", "get-object",
+			"--bucket", bucket,
+			"--key", key,
+			"--if-none-match", etag}
+		args = append(args, conf.AwsOptions(bucket)...)
+		cmd := proc.Command(ctx, "aws", append(args, tmppath)...)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			if terr := proc.Err(ctx, "aws s3api get-object"); terr != nil {
+				return terr
+			}
+			return fmt.Errorf("aws s3api get-object failed -- %s", errbuf.String())
+		}
+		if conf.Verify {
+			var err error
+			digest, err = checkDownload(bucket, key, tmppath, outbuf.Bytes())
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		if proc.IsTimeout(err) {
+			return
+		}
 		errstr := string(errbuf.Bytes())
 		notModified := strings.Contains(errstr, "Not Modified") && strings.Contains(errstr, "(304)")
 		if notModified {
@@ -111,7 +136,6 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 		if noSuchKey {
 			cat.Delete(bucket, key)
 		}
-		err = fmt.Errorf("aws s3api get-object failed -- %s", errstr)
 		return
 	}
 
@@ -121,7 +145,7 @@ func GetObject(bucket string, key string, force bool) (retpath string, metapath
 	}
 
 	// Save the meta info
-	ioutil.WriteFile(metapath, outbuf.Bytes(), 0644)
+	ioutil.WriteFile(metapath, withDigest(outbuf.Bytes(), digest), 0644)
 
 	// Update catalog with the new etag
 	etag = extractETag(metapath)
@@ -15,8 +15,12 @@ package s3
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"strings"
 )
 
@@ -29,20 +33,29 @@ type ListCollection struct {
 	Contents []ListRecord
 }
 
-func ListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func ListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return listOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "aws s3api list-objects", list, notify)
+}
+
+func listOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
 	var err error
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 
 	// invoke s3api to list objects
 	var cmd *exec.Cmd
 	if prefix == "" {
-		cmd = exec.Command("aws", "s3api", "list-objects-v2",
+		cmd = proc.Command(ctx, "aws", append([]string{"s3api", "list-objects-v2",
 			"--bucket", bucket,
-			"--query", "Contents[].{Key: Key, ETag: ETag}")
+			"--query", "Contents[].{Key: Key, ETag: ETag}"}, conf.AwsOptions(bucket)...)...)
 	} else {
-		cmd = exec.Command("aws", "s3api", "list-objects-v2",
+		cmd = proc.Command(ctx, "aws", append([]string{"s3api", "list-objects-v2",
 			"--bucket", bucket,
 			"--prefix", prefix,
-			"--query", "Contents[].{Key: Key, ETag: ETag}")
+			"--query", "Contents[].{Key: Key, ETag: ETag}"}, conf.AwsOptions(bucket)...)...)
 	}
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -93,7 +106,10 @@ func ListObjects(bucket string, prefix string, notify func(key, etag string)) er
 
 	// clean up
 	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("aws s3api list-objects failed -- %v", err)
+		if terr := proc.Err(ctx, "aws s3api list-objects"); terr != nil {
+			return terr
+		}
+		return fmt.Errorf("aws s3api list-objects failed -- %v %s", err, errbuf.String())
 	}
 
 	return nil
@@ -0,0 +1,438 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"s3pool/cache"
+	"s3pool/cat"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/strlock"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A file of at least conf.MultipartThreshold bytes is pushed in a
+// multipart upload. The file is cut into parts of conf.MultipartSize
+// bytes, conf.MultipartConcurrency of which are uploaded at once, each
+// from a copy in tmp/s3p_*. The state of the upload is kept in
+// tmp/s3u_*.json and saved after each part, so that an upload cut
+// short by a restart is completed by ResumeUploads, or by the next PUSH
+// of the same file. An upload that fails otherwise is aborted.
+
+const MAXPARTS = 10000
+
+type upload struct {
+	Bucket   string
+	Key      string
+	File     string
+	Size     int64
+	ModTime  int64 // of File, in ns
+	PartSize int64
+	UploadId string
+	Parts    map[int]string // ETag of each part uploaded
+
+	path string     // of the state file
+	mux  sync.Mutex // protects Parts and the state file
+}
+
+// Return the path of the state file of the upload of bucket:key
+func uploadPath(bucket, key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return filepath.Join("tmp", fmt.Sprintf("s3u_%016x.json", h.Sum64()))
+}
+
+func loadUpload(path string) (*upload, error) {
+	byt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{path: path}
+	if err = json.Unmarshal(byt, u); err != nil {
+		return nil, fmt.Errorf("Cannot parse %s -- %v", path, err)
+	}
+	if u.Parts == nil {
+		u.Parts = make(map[int]string)
+	}
+	return u, nil
+}
+
+// Write the state file. Caller must hold u.mux.
+func (u *upload) save() error {
+	byt, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmppath := u.path + ".tmp"
+	if err = ioutil.WriteFile(tmppath, byt, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, u.path)
+}
+
+// Return true if File is still the file the upload started with
+func (u *upload) unchanged() bool {
+	fi, err := os.Stat(u.File)
+	return err == nil && fi.Size() == u.Size && fi.ModTime().UnixNano() == u.ModTime
+}
+
+// Run aws s3api op on the bucket of the upload, and return its output
+func (u *upload) s3api(ctx context.Context, op string, args ...string) ([]byte, error) {
+	var outbuf, errbuf bytes.Buffer
+	args = append([]string{"s3api", op, "--bucket", u.Bucket, "--key", u.Key}, args...)
+	cmd := proc.Command(ctx, "aws", append(args, conf.AwsOptions(u.Bucket)...)...)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		if terr := proc.Err(ctx, "aws s3api "+op); terr != nil {
+			return nil, terr
+		}
+		return nil, fmt.Errorf("aws s3api %s failed -- %s", op, errbuf.String())
+	}
+	return outbuf.Bytes(), nil
+}
+
+// Push fname to bucket:key in a multipart upload, resuming the upload
+// of fname that was cut short if there is one. Uploads of the same key
+// must not run at once. Returns the output of complete-multipart-upload.
+func putMultipart(ctx context.Context, bucket, key, fname string, fi os.FileInfo) ([]byte, error) {
+	u, err := loadUpload(uploadPath(bucket, key))
+	if err == nil && (u.File != fname || !u.unchanged()) {
+		// the upload of another file, or of an older version
+		u.abort()
+		u = nil
+	}
+	if u == nil {
+		u = &upload{Bucket: bucket, Key: key, File: fname,
+			Size: fi.Size(), ModTime: fi.ModTime().UnixNano(),
+			PartSize: conf.MultipartSize, Parts: make(map[int]string),
+			path: uploadPath(bucket, key)}
+		for (u.Size+u.PartSize-1)/u.PartSize > MAXPARTS {
+			u.PartSize *= 2
+		}
+		if err = u.start(ctx); err != nil {
+			return nil, err
+		}
+	} else if conf.Verbose(1) {
+		log.Printf(" ... resume upload of %s:%s, %d parts done\n", bucket, key, len(u.Parts))
+	}
+	return u.finish(ctx)
+}
+
+// Create the multipart upload and its state file
+func (u *upload) start(ctx context.Context) error {
+	var out []byte
+	err := retry.Do(ctx, "aws s3api create-multipart-upload", func() error {
+		var err error
+		out, err = u.s3api(ctx, "create-multipart-upload")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var reply struct{ UploadId string }
+	if err = json.Unmarshal(out, &reply); err != nil || reply.UploadId == "" {
+		return fmt.Errorf("aws s3api create-multipart-upload output format error")
+	}
+	u.UploadId = reply.UploadId
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if err = u.save(); err != nil {
+		u.abort()
+		return err
+	}
+	return nil
+}
+
+// Upload the parts left and complete the upload. On failure, the
+// upload is aborted unless ctx was canceled, which happens on shutdown
+// and leaves the upload to ResumeUploads. Returns the output of
+// complete-multipart-upload.
+func (u *upload) finish(ctx context.Context) ([]byte, error) {
+	var out []byte
+	err := u.uploadParts(ctx)
+	if err == nil {
+		out, err = u.complete(ctx)
+	}
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			log.Printf("upload of %s:%s interrupted; resume on restart\n", u.Bucket, u.Key)
+		} else {
+			u.abort()
+		}
+	}
+	return out, err
+}
+
+func (u *upload) uploadParts(ctx context.Context) error {
+	nparts := int((u.Size + u.PartSize - 1) / u.PartSize)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var once sync.Once
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.MultipartConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range todo {
+				if err := u.uploadPart(ctx, n); err != nil {
+					// the first error stops the other parts
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for n := 1; n <= nparts; n++ {
+		u.mux.Lock()
+		_, done := u.Parts[n]
+		u.mux.Unlock()
+		if done {
+			continue
+		}
+		select {
+		case todo <- n:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = proc.Err(ctx, "aws s3api upload-part")
+	}
+	return firstErr
+}
+
+// Upload part n from a copy of it in tmp/, and record its ETag
+func (u *upload) uploadPart(ctx context.Context, n int) error {
+	off := int64(n-1) * u.PartSize
+	size := u.Size - off
+	if size > u.PartSize {
+		size = u.PartSize
+	}
+	partpath, sum, err := u.copyPart(off, size)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partpath)
+
+	var out []byte
+	err = retry.Do(ctx, "aws s3api upload-part", func() error {
+		var err error
+		out, err = u.s3api(ctx, "upload-part",
+			"--upload-id", u.UploadId,
+			"--part-number", strconv.Itoa(n),
+			"--body", partpath,
+			"--content-md5", base64.StdEncoding.EncodeToString(sum))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var reply struct{ ETag string }
+	if err = json.Unmarshal(out, &reply); err != nil || reply.ETag == "" {
+		return fmt.Errorf("aws s3api upload-part output format error")
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.Parts[n] = reply.ETag
+	return u.save()
+}
+
+// Copy size bytes at off of File to a temp file. Returns its path and
+// the MD5 of the part.
+func (u *upload) copyPart(off, size int64) (string, []byte, error) {
+	f, err := os.Open(u.File)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	fp, err := ioutil.TempFile("tmp", "s3p_")
+	if err != nil {
+		return "", nil, fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	defer fp.Close()
+	h := md5.New()
+	k, err := io.Copy(io.MultiWriter(fp, h), io.NewSectionReader(f, off, size))
+	if err == nil && k != size {
+		err = errors.New("file changed during upload")
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", nil, fmt.Errorf("Cannot copy part of %s -- %v", u.File, err)
+	}
+	path, err := filepath.Abs(fp.Name())
+	return path, h.Sum(nil), err
+}
+
+// Complete the upload from its parts and remove the state file.
+// Returns the output of complete-multipart-upload.
+func (u *upload) complete(ctx context.Context) ([]byte, error) {
+	type part struct {
+		ETag       string
+		PartNumber int
+	}
+	var parts struct{ Parts []part }
+	for n, etag := range u.Parts {
+		parts.Parts = append(parts.Parts, part{etag, n})
+	}
+	sort.Slice(parts.Parts, func(i, j int) bool {
+		return parts.Parts[i].PartNumber < parts.Parts[j].PartNumber
+	})
+	byt, err := json.Marshal(&parts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the list of parts may be too long for the command line
+	fp, err := ioutil.TempFile("tmp", "s3p_")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create temp file -- %v", err)
+	}
+	defer os.Remove(fp.Name())
+	_, err = fp.Write(byt)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	partspath, err := filepath.Abs(fp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	err = retry.Do(ctx, "aws s3api complete-multipart-upload", func() error {
+		var err error
+		out, err = u.s3api(ctx, "complete-multipart-upload",
+			"--upload-id", u.UploadId,
+			"--multipart-upload", "file://"+partspath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(u.path)
+	return out, nil
+}
+
+// Abort the upload, which frees the parts uploaded, and remove the
+// state file. This is done even if the request was canceled.
+func (u *upload) abort() {
+	ctx, cancel := proc.WithTimeout(context.Background(), conf.PutTimeout)
+	defer cancel()
+	err := retry.Do(ctx, "aws s3api abort-multipart-upload", func() error {
+		_, err := u.s3api(ctx, "abort-multipart-upload", "--upload-id", u.UploadId)
+		if err != nil && strings.Contains(err.Error(), "NoSuchUpload") {
+			// completed or aborted already
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("cannot abort upload of %s:%s -- %v\n", u.Bucket, u.Key, err)
+	}
+	os.Remove(u.path)
+}
+
+// Complete the multipart uploads that were cut short when s3pool last
+// stopped, or abort those whose file has changed or is gone. The
+// uploads of the files for which skip returns true are left alone.
+func ResumeUploads(ctx context.Context, skip func(fname string) bool) {
+	paths, _ := filepath.Glob(filepath.Join("tmp", "s3u_*.json"))
+	for _, path := range paths {
+		u, err := loadUpload(path)
+		if err != nil {
+			log.Println(err)
+			os.Remove(path)
+			continue
+		}
+		if skip(u.File) {
+			continue
+		}
+		if err = resumeUpload(ctx, u.Bucket, u.Key); err != nil {
+			log.Printf("cannot resume upload of %s:%s -- %v\n", u.Bucket, u.Key, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func resumeUpload(ctx context.Context, bucket, key string) error {
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
+	if err != nil {
+		return err
+	}
+	defer strlock.Unlock(lockname)
+
+	// a PUSH of the key may have finished the upload meanwhile
+	u, err := loadUpload(uploadPath(bucket, key))
+	if err != nil {
+		return nil
+	}
+	if !u.unchanged() {
+		log.Printf("abort upload of %s:%s; %s has changed\n", bucket, key, u.File)
+		u.abort()
+		return nil
+	}
+	log.Printf("resume upload of %s:%s, %d parts done\n", bucket, key, len(u.Parts))
+
+	ctx, cancel := proc.WithTimeout(ctx, conf.PutTimeout)
+	defer cancel()
+	out, err := u.finish(ctx)
+	if err != nil {
+		return err
+	}
+	etag, meta, err := uploaded(out)
+	if err != nil {
+		return err
+	}
+	// keep the file pushed as the cached object, as PUSH does
+	if err = cache.Keep(bucket, key, u.File, meta); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
+	}
+	cat.Upsert(bucket, key, etag)
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package s3
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fake aws that logs each call to aws.log in its directory and
+// answers as s3api would. A part fails for good if failpart-N exists
+// in the directory, fails once with a transient error if flaky-N
+// exists, and every part hangs if hang exists.
+const fakeAws = `#!/bin/bash
+dir=$(dirname "$0")
+op=$2
+while [ $# -gt 0 ]; do
+	case $1 in
+	--part-number) part=$2 ;;
+	--upload-id) id=$2 ;;
+	--body) body=$2 ;;
+	--multipart-upload) cp "${2#file://}" "$dir/parts.json" ;;
+	esac
+	shift
+done
+echo "$op $id $part $([ -n "$body" ] && wc -c < "$body")" >> "$dir/aws.log"
+case $op in
+create-multipart-upload) echo '{"UploadId":"new"}' ;;
+upload-part)
+	[ -f "$dir/hang" ] && sleep 60
+	if [ -f "$dir/failpart-$part" ]; then echo "An error occurred (AccessDenied)" >&2; exit 1; fi
+	if [ -f "$dir/flaky-$part" ]; then rm "$dir/flaky-$part"; echo "An error occurred (InternalError)" >&2; exit 1; fi
+	echo "{\"ETag\":\"\\\"e$part\\\"\"}" ;;
+complete-multipart-upload) echo '{"ETag":"\"done\"","VersionId":"v1"}' ;;
+esac
+`
+
+// Put the fake aws first in PATH in a fresh home directory, with parts
+// of 1000 bytes. Returns the directory of the fake.
+func fakeS3(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	if err = os.Chdir(home); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir("tmp", 0755)
+	bin := filepath.Join(home, "bin")
+	os.Mkdir(bin, 0755)
+	if err = ioutil.WriteFile(filepath.Join(bin, "aws"), []byte(fakeAws), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+":"+path)
+	saveSize, saveConc, saveAttempts, saveDelay := conf.MultipartSize, conf.MultipartConcurrency, conf.RetryAttempts, conf.RetryDelay
+	conf.MultipartSize, conf.MultipartConcurrency, conf.RetryAttempts, conf.RetryDelay = 1000, 2, 3, 1
+	t.Cleanup(func() {
+		conf.MultipartSize, conf.MultipartConcurrency, conf.RetryAttempts, conf.RetryDelay = saveSize, saveConc, saveAttempts, saveDelay
+		os.Setenv("PATH", path)
+		os.Chdir(wd)
+	})
+	return bin
+}
+
+// Write a file of size bytes to push
+func pushFile(t *testing.T, size int64) (string, os.FileInfo) {
+	fname, _ := filepath.Abs("file")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(size)
+	f.Close()
+	fi, _ := os.Stat(fname)
+	return fname, fi
+}
+
+// Return the calls logged by the fake aws of op
+func awsCalls(bin, op string) (calls []string) {
+	byt, _ := ioutil.ReadFile(filepath.Join(bin, "aws.log"))
+	for _, line := range strings.Split(string(byt), "\n") {
+		if strings.HasPrefix(line, op+" ") {
+			calls = append(calls, strings.TrimSpace(line))
+		}
+	}
+	return
+}
+
+// Check that the upload left no temp files behind, and that its state
+// file is kept or not
+func checkTmp(t *testing.T, kept bool) {
+	parts, _ := filepath.Glob("tmp/s3p_*")
+	if len(parts) != 0 {
+		t.Errorf("temp files %v left", parts)
+	}
+	if fileExists(uploadPath("b", "k")) != kept {
+		t.Errorf("state file kept is %v, want %v", !kept, kept)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestMultipartParts(t *testing.T) {
+	bin := fakeS3(t)
+	fname, fi := pushFile(t, 2500)
+	ioutil.WriteFile(filepath.Join(bin, "flaky-2"), nil, 0644)
+
+	out, err := putMultipart(context.Background(), "b", "k", fname, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag, _, err := uploaded(out); err != nil || etag != "done" {
+		t.Errorf("uploaded() = %q, %v", etag, err)
+	}
+
+	// the last part is what is left, and a transient failure is retried
+	parts := awsCalls(bin, "upload-part")
+	want := map[string]bool{"upload-part new 1 1000": true, "upload-part new 2 1000": true, "upload-part new 3 500": true}
+	if len(parts) != 4 {
+		t.Errorf("parts uploaded %v, want 3 and a retry", parts)
+	}
+	for _, call := range parts {
+		if !want[call] {
+			t.Errorf("unexpected call %q", call)
+		}
+	}
+
+	// completed from the parts in order
+	byt, _ := ioutil.ReadFile(filepath.Join(bin, "parts.json"))
+	if s := string(byt); s != `{"Parts":[{"ETag":"\"e1\"","PartNumber":1},{"ETag":"\"e2\"","PartNumber":2},{"ETag":"\"e3\"","PartNumber":3}]}` {
+		t.Errorf("completed with %s", s)
+	}
+	checkTmp(t, false)
+}
+
+func TestMultipartAbort(t *testing.T) {
+	bin := fakeS3(t)
+	fname, fi := pushFile(t, 5000)
+	ioutil.WriteFile(filepath.Join(bin, "failpart-2"), nil, 0644)
+
+	if _, err := putMultipart(context.Background(), "b", "k", fname, fi); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("putMultipart() = %v, want AccessDenied", err)
+	}
+	if calls := awsCalls(bin, "upload-part"); len(calls) > 4 {
+		t.Errorf("parts uploaded after a failure: %v", calls)
+	}
+	if calls := awsCalls(bin, "abort-multipart-upload"); len(calls) != 1 || calls[0] != "abort-multipart-upload new" {
+		t.Errorf("aborted with %v", calls)
+	}
+	if calls := awsCalls(bin, "complete-multipart-upload"); len(calls) != 0 {
+		t.Errorf("completed a failed upload: %v", calls)
+	}
+	checkTmp(t, false)
+}
+
+// An upload cut short keeps its state, and the part size grows so that
+// no upload has more than MAXPARTS parts
+func TestMultipartInterrupted(t *testing.T) {
+	bin := fakeS3(t)
+	conf.MultipartSize = 1
+	fname, fi := pushFile(t, 2*MAXPARTS+1)
+	ioutil.WriteFile(filepath.Join(bin, "hang"), nil, 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for len(awsCalls(bin, "upload-part")) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	if _, err := putMultipart(ctx, "b", "k", fname, fi); err == nil {
+		t.Fatal("putMultipart() succeeded after cancel")
+	}
+	if calls := awsCalls(bin, "abort-multipart-upload"); len(calls) != 0 {
+		t.Errorf("aborted an interrupted upload: %v", calls)
+	}
+	checkTmp(t, true)
+
+	u, err := loadUpload(uploadPath("b", "k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PartSize != 4 || u.UploadId != "new" || u.File != fname {
+		t.Errorf("state file has part size %d, upload id %q and file %q", u.PartSize, u.UploadId, u.File)
+	}
+}
+
+// Write the state of an upload cut short after its first part
+func cutShort(t *testing.T, fname string, fi os.FileInfo) {
+	u := &upload{Bucket: "b", Key: "k", File: fname, Size: fi.Size(),
+		ModTime: fi.ModTime().UnixNano(), PartSize: 1000, UploadId: "old",
+		Parts: map[int]string{1: `"e1"`}, path: uploadPath("b", "k")}
+	if err := u.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipartResume(t *testing.T) {
+	bin := fakeS3(t)
+	fname, fi := pushFile(t, 3000)
+	cutShort(t, fname, fi)
+
+	if _, err := putMultipart(context.Background(), "b", "k", fname, fi); err != nil {
+		t.Fatal(err)
+	}
+	if calls := awsCalls(bin, "create-multipart-upload"); len(calls) != 0 {
+		t.Errorf("started a new upload: %v", calls)
+	}
+	calls := awsCalls(bin, "upload-part")
+	if len(calls) != 2 || calls[0] == "upload-part old 1 1000" || calls[1] == "upload-part old 1 1000" {
+		t.Errorf("resumed with %v, want parts 2 and 3", calls)
+	}
+	if calls := awsCalls(bin, "complete-multipart-upload"); len(calls) != 1 || calls[0] != "complete-multipart-upload old" {
+		t.Errorf("completed with %v", calls)
+	}
+	checkTmp(t, false)
+}
+
+func TestMultipartResumeChanged(t *testing.T) {
+	bin := fakeS3(t)
+	fname, fi := pushFile(t, 3000)
+	cutShort(t, fname, fi)
+	fname, fi = pushFile(t, 2000)
+
+	if _, err := putMultipart(context.Background(), "b", "k", fname, fi); err != nil {
+		t.Fatal(err)
+	}
+	if calls := awsCalls(bin, "abort-multipart-upload"); len(calls) != 1 || calls[0] != "abort-multipart-upload old" {
+		t.Errorf("aborted with %v, want the old upload", calls)
+	}
+	if calls := awsCalls(bin, "upload-part"); len(calls) != 2 || !strings.HasPrefix(calls[0], "upload-part new") {
+		t.Errorf("uploaded %v, want 2 parts of a new upload", calls)
+	}
+	checkTmp(t, false)
+}
+
+// An upload of a file since removed is aborted by ResumeUploads, and
+// an upload skipped is left alone
+func TestResumeUploads(t *testing.T) {
+	bin := fakeS3(t)
+	fname, fi := pushFile(t, 3000)
+	cutShort(t, fname, fi)
+
+	ResumeUploads(context.Background(), func(string) bool { return true })
+	checkTmp(t, true)
+
+	os.Remove(fname)
+	ResumeUploads(context.Background(), func(string) bool { return false })
+	if calls := awsCalls(bin, "abort-multipart-upload"); len(calls) != 1 {
+		t.Errorf("aborted with %v", calls)
+	}
+	checkTmp(t, false)
+}
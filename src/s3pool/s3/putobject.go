@@ -14,19 +14,24 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"s3pool/cache"
 	"s3pool/cat"
 	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"s3pool/strlock"
+	"strings"
 )
 
 //
 // aws s3api put-object
 //
-func PutObject(bucket, key, fname string) error {
+func PutObject(ctx context.Context, bucket, key, fname string) error {
 	if conf.Verbose(1) {
 		log.Println("s3 put-object", bucket, key, fname)
 	}
@@ -36,34 +41,79 @@ func PutObject(bucket, key, fname string) error {
 	}
 
 	// lock to serialize on (bucket,key)
-	lockname, err := strlock.Lock(bucket + ":" + key)
+	lockname, err := strlock.LockContext(ctx, bucket+":"+key)
 	if err != nil {
 		return err
 	}
 	defer strlock.Unlock(lockname)
 
-	// we need to remove the file and meta file from cache if they are there
-	datapath, err := mapToPath(bucket, key)
-	if err != nil {
+	// the cached object is stale once the upload starts
+	if err = cache.Remove(bucket, key); err != nil {
 		return err
 	}
-	metapath := datapath + "__meta__"
-	os.Remove(metapath)
-	os.Remove(datapath)
 
-	// push the file to AWS
-	cmd := exec.Command("aws", "s3api", "put-object",
-		"--bucket", bucket,
-		"--key", key,
-		"--body", fname)
-	var errbuf bytes.Buffer
-	cmd.Stderr = &errbuf
-	err = cmd.Run()
+	etag, meta, err := Upload(ctx, bucket, key, fname)
 	if err != nil {
-		return fmt.Errorf("aws s3api put-object failed -- %s", errbuf.String())
+		return err
+	}
+
+	// keep the file pushed as the cached object, so that the next
+	// PULL does not fetch it again
+	if err = cache.Keep(bucket, key, fname, meta); err != nil {
+		log.Printf("cannot cache %s:%s -- %v\n", bucket, key, err)
 	}
 
 	// reflect the new file in our catalog
-	cat.Upsert(bucket, key, "new")
+	cat.Upsert(bucket, key, etag)
 	return nil
 }
+
+// Upload the file fname to bucket:key without touching the cache.
+// Uploads of the same key must not run at once. Returns the ETag of
+// the object uploaded and the content of its meta file.
+func Upload(ctx context.Context, bucket, key, fname string) (etag string, meta []byte, err error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+
+	// push the file to AWS
+	ctx, cancel := proc.WithTimeout(ctx, conf.PutTimeout)
+	defer cancel()
+	if fi.Size() >= conf.MultipartThreshold {
+		meta, err = putMultipart(ctx, bucket, key, fname, fi)
+	} else {
+		err = retry.Do(ctx, "aws s3api put-object", func() error {
+			args := []string{"s3api", "put-object",
+				"--bucket", bucket,
+				"--key", key,
+				"--body", fname}
+			cmd := proc.Command(ctx, "aws", append(args, conf.AwsOptions(bucket)...)...)
+			var outbuf, errbuf bytes.Buffer
+			cmd.Stdout = &outbuf
+			cmd.Stderr = &errbuf
+			if err := cmd.Run(); err != nil {
+				if terr := proc.Err(ctx, "aws s3api put-object"); terr != nil {
+					return terr
+				}
+				return fmt.Errorf("aws s3api put-object failed -- %s", errbuf.String())
+			}
+			meta = outbuf.Bytes()
+			return nil
+		})
+	}
+	if err != nil {
+		return
+	}
+	return uploaded(meta)
+}
+
+// Return the ETag in the output of put-object or
+// complete-multipart-upload, and the output as the meta file
+func uploaded(out []byte) (etag string, meta []byte, err error) {
+	var reply struct{ ETag string }
+	if err = json.Unmarshal(out, &reply); err != nil || reply.ETag == "" {
+		return "", nil, fmt.Errorf("aws s3api upload output format error")
+	}
+	return strings.Trim(reply.ETag, "\""), out, nil
+}
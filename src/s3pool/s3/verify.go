@@ -0,0 +1,73 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package s3
+
+import (
+	"encoding/json"
+	"s3pool/verify"
+	"strconv"
+	"strings"
+)
+
+// Check the download at tmppath of bucket:key against the ContentLength
+// and ETag in meta, the reply of get-object. The ETag is the MD5 of the
+// content only for objects uploaded in one part and not encrypted with
+// KMS or a customer key; other objects are checked by size. Returns
+// the digest verified.
+func checkDownload(bucket, key, tmppath string, meta []byte) (string, error) {
+	var m struct {
+		ETag                 string
+		ContentLength        int64
+		ServerSideEncryption string
+		SSECustomerAlgorithm string
+	}
+	if err := json.Unmarshal(meta, &m); err != nil {
+		return "", nil
+	}
+
+	size, err := verify.Size(tmppath)
+	if err != nil {
+		return "", err
+	}
+	want, got := strconv.FormatInt(m.ContentLength, 10), strconv.FormatInt(size, 10)
+	if err = verify.Match(bucket, key, tmppath, "size", want, got); err != nil {
+		return "", err
+	}
+
+	etag := strings.Trim(m.ETag, "\"")
+	plain := m.ServerSideEncryption == "" || m.ServerSideEncryption == "AES256"
+	if len(etag) != 32 || !plain || m.SSECustomerAlgorithm != "" {
+		return "size:" + got, nil
+	}
+	if got, err = verify.MD5(tmppath); err != nil {
+		return "", err
+	}
+	if err = verify.Match(bucket, key, tmppath, "md5", etag, got); err != nil {
+		return "", err
+	}
+	return "md5:" + got, nil
+}
+
+// Add the digest verified to meta as the Digest entry
+func withDigest(meta []byte, digest string) []byte {
+	var dat map[string]interface{}
+	if digest == "" || json.Unmarshal(meta, &dat) != nil {
+		return meta
+	}
+	dat["Digest"] = digest
+	byt, err := json.MarshalIndent(dat, "", "    ")
+	if err != nil {
+		return meta
+	}
+	return append(byt, '\n')
+}
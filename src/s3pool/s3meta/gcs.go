@@ -16,6 +16,10 @@ import (
 	"cloud.google.com/go/storage"
 	"context"
 	"google.golang.org/api/iterator"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/version"
 )
 
 var g_ctx context.Context
@@ -30,7 +34,14 @@ type ListCollection struct {
 	Contents []ListRecord
 }
 
-func gcsListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func gcsListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return gcsListOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "gcs list", list, notify)
+}
+
+func gcsListOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
 	var err error = nil
 
 	if g_client == nil {
@@ -43,20 +54,25 @@ func gcsListObjects(bucket string, prefix string, notify func(key, etag string))
 
 	bkt := g_client.Bucket(bucket)
 	query := &storage.Query{Prefix: prefix}
-	query.SetAttrSelection([]string{"Name"})
+	query.SetAttrSelection([]string{"Name", "Generation"})
 
-	it := bkt.Objects(g_ctx, query)
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
+	it := bkt.Objects(ctx, query)
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
+			if terr := proc.Err(ctx, "gcs list"); terr != nil {
+				return terr
+			}
 			return err
 		}
 
 		key := attrs.Name
-		etag := "0"
+		etag := version.Gcs(attrs.Generation)
 		notify(key, etag)
 	}
 
@@ -15,9 +15,13 @@ package s3meta
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"strings"
 )
 
@@ -32,7 +36,16 @@ type listCollection struct {
 }
 */
 
-func hdfsListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func hdfsListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return hdfsListOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "gohdfs checksum", list, notify)
+}
+
+func hdfsListOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 	var err error
 
 	log.Println("hdfsListObjects", bucket, prefix)
@@ -41,11 +54,12 @@ func hdfsListObjects(bucket string, prefix string, notify func(key, etag string)
 	var cmd *exec.Cmd
 	if prefix == "" {
 		dfspath := "/" + bucket
-		cmd = exec.Command("gohdfs", "checksum", dfspath)
+		cmd = proc.Command(ctx, "gohdfs", "checksum", dfspath)
 	} else {
 		dfspath := "/" + bucket + "/" + prefix
-		cmd = exec.Command("gohdfs", "checksum", dfspath)
+		cmd = proc.Command(ctx, "gohdfs", "checksum", dfspath)
 	}
+	cmd.Env = conf.HdfsEnv(bucket)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	pipe, _ := cmd.StdoutPipe()
@@ -80,7 +94,10 @@ func hdfsListObjects(bucket string, prefix string, notify func(key, etag string)
 
 	// clean up
 	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("gohdfs checksum failed -- %v", err)
+		if terr := proc.Err(ctx, "gohdfs checksum"); terr != nil {
+			return terr
+		}
+		return fmt.Errorf("gohdfs checksum failed -- %v %s", err, errbuf.String())
 	}
 
 	return nil
@@ -15,9 +15,14 @@ package s3meta
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
+	"s3pool/version"
 	"strings"
 )
 
@@ -32,7 +37,19 @@ type listCollection struct {
 }
 */
 
-func hdfs2xListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+// max files given to one hadoop fs -stat
+const HDFSSTATBATCH = 500
+
+func hdfs2xListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return hdfs2xListOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "hadoop fs -ls", list, notify)
+}
+
+func hdfs2xListOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 	var err error
 
 	log.Println("hdfs2xListObjects", bucket, prefix)
@@ -41,10 +58,10 @@ func hdfs2xListObjects(bucket string, prefix string, notify func(key, etag strin
 	var cmd *exec.Cmd
 	if prefix == "" {
 		dfspath := "/" + bucket
-		cmd = exec.Command("hadoop", "fs", "-ls", dfspath)
+		cmd = proc.Command(ctx, "hadoop", append(append([]string{"fs"}, conf.HadoopOptions(bucket)...), "-ls", dfspath)...)
 	} else {
 		dfspath := "/" + bucket + "/" + prefix
-		cmd = exec.Command("hadoop", "fs", "-ls", dfspath)
+		cmd = proc.Command(ctx, "hadoop", append(append([]string{"fs"}, conf.HadoopOptions(bucket)...), "-ls", dfspath)...)
 	}
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -57,7 +74,7 @@ func hdfs2xListObjects(bucket string, prefix string, notify func(key, etag strin
 	// read stdout of cmd
 	scanner := bufio.NewScanner(pipe)
 	var key string
-	var etag string
+	var keys []string
 	for scanner.Scan() {
 		s := scanner.Text()
 		// Parse s of the form "etag key"
@@ -72,12 +89,11 @@ func hdfs2xListObjects(bucket string, prefix string, notify func(key, etag strin
 		}
 
 		// extract key value
-		etag = "0"
 		key = s[idx+1:]
 		key = strings.Trim(key, " \t")
 		key = strings.TrimPrefix(key, "/"+bucket+"/")
 
-		notify(key, etag)
+		keys = append(keys, key)
 	}
 	if err = scanner.Err(); err != nil {
 		return fmt.Errorf("hadoop fs -ls failed -- %v", err)
@@ -85,7 +101,33 @@ func hdfs2xListObjects(bucket string, prefix string, notify func(key, etag strin
 
 	// clean up
 	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("hadoop fs -ls failed -- %v", err)
+		if terr := proc.Err(ctx, "hadoop fs -ls"); terr != nil {
+			return terr
+		}
+		return fmt.Errorf("hadoop fs -ls failed -- %v %s", err, errbuf.String())
+	}
+
+	// the etags are the length and modification time of the files,
+	// which hadoop fs -ls only gives to the minute
+	for i := 0; i < len(keys); i += HDFSSTATBATCH {
+		batch := keys[i:]
+		if len(batch) > HDFSSTATBATCH {
+			batch = batch[:HDFSSTATBATCH]
+		}
+		paths := make([]string, len(batch))
+		for j, k := range batch {
+			paths[j] = "/" + bucket + "/" + k
+		}
+		etags, err := version.Hdfs(ctx, bucket, paths)
+		if err != nil {
+			return err
+		}
+		for j, k := range batch {
+			// skip the files deleted since the listing
+			if etags[j] != "" {
+				notify(k, etags[j])
+			}
+		}
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package s3meta
 
 import (
+	"context"
 	"errors"
 	"s3pool/conf"
 )
@@ -22,8 +23,10 @@ func (p *serverCB) list(req *requestType) (reply *replyType) {
 		return
 	}
 
-	if conf.DfsMode == conf.DFS_HDFS {
-		err := hdfsListObjects(bucket, prefix, func(k, t string) {
+	ctx := context.Background()
+	mode := conf.BucketDfsMode(bucket)
+	if mode == conf.DFS_HDFS {
+		err := hdfsListObjects(ctx, bucket, prefix, func(k, t string) {
 			if k[len(k)-1] == '/' {
 				// skip DIR
 				return
@@ -36,8 +39,8 @@ func (p *serverCB) list(req *requestType) (reply *replyType) {
 			reply = &replyType{err: err}
 			return
 		}
-	} else if conf.DfsMode == conf.DFS_S3 {
-		err := s3ListObjects(bucket, prefix, func(k, t string) {
+	} else if mode == conf.DFS_S3 {
+		err := s3ListObjects(ctx, bucket, prefix, func(k, t string) {
 			if k[len(k)-1] == '/' {
 				// skip DIR
 				return
@@ -50,8 +53,8 @@ func (p *serverCB) list(req *requestType) (reply *replyType) {
 			reply = &replyType{err: err}
 			return
 		}
-	} else if conf.DfsMode == conf.DFS_HDFS2X {
-		err := hdfs2xListObjects(bucket, prefix, func(k, t string) {
+	} else if mode == conf.DFS_HDFS2X {
+		err := hdfs2xListObjects(ctx, bucket, prefix, func(k, t string) {
 			if k[len(k)-1] == '/' {
 				// skip DIR
 				return
@@ -64,8 +67,8 @@ func (p *serverCB) list(req *requestType) (reply *replyType) {
 			reply = &replyType{err: err}
 			return
 		}
-	} else if conf.DfsMode == conf.DFS_LOCAL {
-                err := localListObjects(bucket, prefix, func(k, t string) {
+	} else if mode == conf.DFS_LOCAL {
+                err := localListObjects(ctx, bucket, prefix, func(k, t string) {
                         if k[len(k)-1] == '/' {
                                 // skip DIR
                                 return
@@ -78,8 +81,8 @@ func (p *serverCB) list(req *requestType) (reply *replyType) {
                         reply = &replyType{err: err}
                         return
                 }
-        }  else if conf.DfsMode == conf.DFS_GCS {
-                err := gcsListObjects(bucket, prefix, func(k, t string) {
+        }  else if mode == conf.DFS_GCS {
+                err := gcsListObjects(ctx, bucket, prefix, func(k, t string) {
                         if k[len(k)-1] == '/' {
                                 // skip DIR
                                 return
@@ -13,80 +13,140 @@
 package s3meta
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
+	"context"
+	"io/fs"
 	"log"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/version"
 	"strings"
 )
 
-/*
-type listRec struct {
-	Key  string
-	Etag string
-}
-
-type listCollection struct {
-	Contents []listRec
-}
-*/
-
-func localListObjects(bucket string, prefix string, notify func(key, etag string)) error {
-	var err error
+// List the files of bucket under the source directory whose key
+// starts with prefix. The key of a file is its path relative to the
+// directory of the bucket, and its etag is given by version.Local.
+// Symbolic links are followed or skipped as conf.LocalSymlinks says.
+func localListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 
 	log.Println("localListObjects", bucket, prefix)
 
-	// invoke gohdfs checksum
-	var cmd *exec.Cmd
-	if prefix == "" {
-		dfspath := "/" + bucket
-		cmd = exec.Command("/bin/sh", "-c", "ls " + "-l " + dfspath)
-	} else {
-		dfspath := "/" + bucket + "/" + prefix
-		cmd = exec.Command("/bin/sh", "-c", "ls " + "-l " + dfspath)
+	// walk from the deepest directory that holds every key of prefix
+	dir := ""
+	if idx := strings.LastIndexByte(prefix, '/'); idx >= 0 {
+		dir = prefix[:idx]
+	}
+	real, err := filepath.EvalSymlinks(conf.SourcePath(bucket, dir))
+	if err != nil {
+		if os.IsNotExist(err) && dir != "" {
+			// no key has the prefix
+			return nil
+		}
+		return err
 	}
-	var errbuf bytes.Buffer
-	cmd.Stderr = &errbuf
-	pipe, _ := cmd.StdoutPipe()
-	if err = cmd.Start(); err != nil {
-		return fmt.Errorf("ls -l failed -- %s", string(errbuf.Bytes()))
+	if conf.LocalSymlinks != "follow" && dir != "" {
+		// the keys under a link to a directory are not listed
+		root, err := filepath.EvalSymlinks(conf.SourcePath(bucket, ""))
+		if err != nil {
+			return err
+		}
+		if real != filepath.Join(root, dir) {
+			return nil
+		}
 	}
-	defer cmd.Wait()
+	w := &localWalker{ctx: ctx, prefix: prefix, notify: notify, visited: map[string]bool{}}
+	return w.walk(real, dir)
+}
 
-	// read stdout of cmd
-	scanner := bufio.NewScanner(pipe)
-	var key string
-	var etag string
-	for scanner.Scan() {
-		s := scanner.Text()
-		// Parse s of the form "etag key"
-		// Note: the order of Key and ETag is random, but one must follow another.
-		if strings.HasPrefix(s, "Found") {
-			continue
-		}
+type localWalker struct {
+	ctx     context.Context
+	prefix  string
+	notify  func(key, etag string)
+	visited map[string]bool // real paths of the directories walked
+}
 
-		idx := strings.LastIndex(s, " ")
-		if idx == -1 {
-			continue
+// Walk the directory at the real path dir, whose key is base
+func (w *localWalker) walk(dir, base string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if terr := proc.Err(w.ctx, "local list"); terr != nil {
+			return terr
+		}
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// skip what cannot be read rather than fail the listing
+			log.Printf("local list: %v\n", err)
+			return nil
 		}
 
-		// extract key value
-		etag = "0"
-		key = s[idx+1:]
-		key = strings.Trim(key, " \t")
-		key = strings.TrimPrefix(key, "/"+bucket+"/")
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(filepath.Join(base, rel))
 
-		notify(key, etag)
-	}
-	if err = scanner.Err(); err != nil {
-		return fmt.Errorf("ls -l Failed -- %v", err)
-	}
+		if d.IsDir() {
+			if path != dir && !w.under(key+"/") {
+				return filepath.SkipDir
+			}
+			if conf.LocalSymlinks == "follow" {
+				// a link may lead back to a directory being walked
+				if real, err := filepath.EvalSymlinks(path); err == nil {
+					if w.visited[real] {
+						return filepath.SkipDir
+					}
+					w.visited[real] = true
+				}
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, w.prefix) && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if conf.IsLocalTemp(d.Name()) {
+			// a PUSH in progress
+			return nil
+		}
 
-	// clean up
-	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("ls -l Failed -- %v", err)
-	}
+		fi, err := d.Info()
+		if err != nil {
+			return nil // gone
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if conf.LocalSymlinks != "follow" {
+				return nil
+			}
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return nil // dangling
+			}
+			if fi, err = os.Stat(real); err != nil {
+				return nil
+			}
+			if fi.IsDir() {
+				if !w.under(key + "/") {
+					return nil
+				}
+				return w.walk(real, key)
+			}
+			if !strings.HasPrefix(key, w.prefix) {
+				return nil
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		w.notify(key, version.Local(fi))
+		return nil
+	})
+}
 
-	return nil
+// Return true if keys under the directory dirkey, which ends with a
+// slash, may start with the prefix
+func (w *localWalker) under(dirkey string) bool {
+	return strings.HasPrefix(dirkey, w.prefix) || strings.HasPrefix(w.prefix, dirkey)
 }
@@ -0,0 +1,122 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package s3meta
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"s3pool/conf"
+	"sort"
+	"testing"
+)
+
+// Make a source tree of bucket b under a temp dir:
+//
+//	b/a.csv
+//	b/dir/x.csv
+//	b/dir/y.txt
+//	b/.a.csv.s3pool_123  temp file of a PUSH
+//	b/link.csv -> b/a.csv
+//	b/ext -> other       directory outside the bucket
+//	b/loop -> b          link back to the bucket
+//	b/dangling -> nosuch
+//	other/o.csv
+func sourceTree(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"b/a.csv", "b/dir/x.csv", "b/dir/y.txt", "b/.a.csv.s3pool_123", "other/o.csv"} {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"b/link.csv": filepath.Join(root, "b/a.csv"),
+		"b/ext":      filepath.Join(root, "other"),
+		"b/loop":     filepath.Join(root, "b"),
+		"b/dangling": filepath.Join(root, "nosuch"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saveSrc, saveLinks := conf.SrcPrefix, conf.LocalSymlinks
+	conf.SrcPrefix = root
+	t.Cleanup(func() { conf.SrcPrefix, conf.LocalSymlinks = saveSrc, saveLinks })
+}
+
+func localKeys(t *testing.T, prefix string) []string {
+	var keys []string
+	err := localListObjects(context.Background(), "b", prefix, func(key, etag string) {
+		if etag == "" {
+			t.Errorf("%s has no etag", key)
+		}
+		keys = append(keys, key)
+	})
+	if err != nil {
+		t.Fatalf("list of prefix %q failed -- %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLocalListFollow(t *testing.T) {
+	sourceTree(t)
+	conf.LocalSymlinks = "follow"
+	for _, c := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"a.csv", "dir/x.csv", "dir/y.txt", "ext/o.csv", "link.csv"}},
+		{"dir/", []string{"dir/x.csv", "dir/y.txt"}},
+		{"dir/x", []string{"dir/x.csv"}},
+		{"di", []string{"dir/x.csv", "dir/y.txt"}},
+		{"e", []string{"ext/o.csv"}},
+		{"ext/", []string{"ext/o.csv"}},
+		{"l", []string{"link.csv"}},
+		{"nosuch/", nil},
+	} {
+		if got := localKeys(t, c.prefix); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("prefix %q: listed %v, want %v", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestLocalListSkip(t *testing.T) {
+	sourceTree(t)
+	conf.LocalSymlinks = "skip"
+	want := []string{"a.csv", "dir/x.csv", "dir/y.txt"}
+	if got := localKeys(t, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	if got := localKeys(t, "ext/"); got != nil {
+		t.Errorf("prefix ext/: listed %v, want nothing", got)
+	}
+}
+
+func TestIsLocalTemp(t *testing.T) {
+	for name, want := range map[string]bool{
+		".a.csv.s3pool_123": true,
+		"a.csv":             false,
+		"a.s3pool_1":        false,
+		".hidden":           false,
+	} {
+		if got := conf.IsLocalTemp(name); got != want {
+			t.Errorf("IsLocalTemp(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
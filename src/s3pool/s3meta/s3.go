@@ -15,9 +15,13 @@ package s3meta
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
+	"s3pool/conf"
+	"s3pool/proc"
+	"s3pool/retry"
 	"strings"
 )
 
@@ -30,7 +34,16 @@ type listCollection struct {
 	Contents []listRec
 }
 
-func s3ListObjects(bucket string, prefix string, notify func(key, etag string)) error {
+func s3ListObjects(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	list := func(notify func(key, etag string)) error {
+		return s3ListOnce(ctx, bucket, prefix, notify)
+	}
+	return retry.DoList(ctx, "aws s3api list-objects", list, notify)
+}
+
+func s3ListOnce(ctx context.Context, bucket string, prefix string, notify func(key, etag string)) error {
+	ctx, cancel := proc.WithTimeout(ctx, conf.ListTimeout)
+	defer cancel()
 	var err error
 
 	log.Println("s3ListObjects", bucket, prefix)
@@ -38,14 +51,14 @@ func s3ListObjects(bucket string, prefix string, notify func(key, etag string))
 	// invoke s3api to list objects
 	var cmd *exec.Cmd
 	if prefix == "" {
-		cmd = exec.Command("aws", "s3api", "list-objects-v2",
+		cmd = proc.Command(ctx, "aws", append([]string{"s3api", "list-objects-v2",
 			"--bucket", bucket,
-			"--query", "Contents[].{Key: Key, ETag: ETag}")
+			"--query", "Contents[].{Key: Key, ETag: ETag}"}, conf.AwsOptions(bucket)...)...)
 	} else {
-		cmd = exec.Command("aws", "s3api", "list-objects-v2",
+		cmd = proc.Command(ctx, "aws", append([]string{"s3api", "list-objects-v2",
 			"--bucket", bucket,
 			"--prefix", prefix,
-			"--query", "Contents[].{Key: Key, ETag: ETag}")
+			"--query", "Contents[].{Key: Key, ETag: ETag}"}, conf.AwsOptions(bucket)...)...)
 	}
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -96,7 +109,10 @@ func s3ListObjects(bucket string, prefix string, notify func(key, etag string))
 
 	// clean up
 	if err = cmd.Wait(); err != nil {
-		return fmt.Errorf("aws s3api list-objects failed -- %v", err)
+		if terr := proc.Err(ctx, "aws s3api list-objects"); terr != nil {
+			return terr
+		}
+		return fmt.Errorf("aws s3api list-objects failed -- %v %s", err, errbuf.String())
 	}
 
 	return nil
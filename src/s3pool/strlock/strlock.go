@@ -13,34 +13,139 @@
 package strlock
 
 import (
+	"context"
 	"fmt"
+	"s3pool/conf"
+	"sort"
 	"sync"
 	"time"
 )
 
+// A lock on a name such as "bucket:key". Each lock records who holds
+// it and since when, and who is waiting for it, so that a stuck holder
+// can be found with LOCKS. Waiters give up when their context is done
+// or after conf.LockTimeout seconds.
+
+type waiter struct {
+	owner string
+	since time.Time
+}
+
+type lock struct {
+	owner  string
+	since  time.Time
+	done   chan struct{} // closed on unlock
+	waiter map[*waiter]bool
+}
+
 var tabmux sync.Mutex
-var tabcond *sync.Cond
-var tab = map[string]bool{}
+var tab = map[string]*lock{}
 
-func init() {
-	tabcond = sync.NewCond(&tabmux)
+type ownerKey struct{}
+
+// Return a copy of ctx that names owner as the holder of the locks
+// taken with it
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+func ownerOf(ctx context.Context) string {
+	if owner, ok := ctx.Value(ownerKey{}).(string); ok && owner != "" {
+		return owner
+	}
+	return "unknown"
 }
 
 func Lock(s string) (*string, error) {
+	return LockContext(context.Background(), s)
+}
+
+// Lock s, waiting until it is free, ctx is done or conf.LockTimeout
+// seconds have passed
+func LockContext(ctx context.Context, s string) (*string, error) {
+	if conf.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(conf.LockTimeout)*time.Second)
+		defer cancel()
+	}
+	w := &waiter{ownerOf(ctx), time.Now()}
+
 	tabmux.Lock()
 	defer tabmux.Unlock()
-	for tab[s] {
-		tabcond.Wait()
+	for {
+		l := tab[s]
+		if l == nil {
+			break
+		}
+		l.waiter[w] = true
+		tabmux.Unlock()
+		select {
+		case <-l.done:
+			tabmux.Lock()
+			delete(l.waiter, w)
+		case <-ctx.Done():
+			tabmux.Lock()
+			delete(l.waiter, w)
+			reason := "canceled"
+			if ctx.Err() == context.DeadlineExceeded {
+				reason = "timed out"
+			}
+			return nil, fmt.Errorf("%s waiting for lock %s held by %s for %v",
+				reason, s, l.owner, time.Since(l.since).Round(time.Second))
+		}
 	}
-	tab[s] = true
+	tab[s] = &lock{w.owner, time.Now(), make(chan struct{}), map[*waiter]bool{}}
+	return &s, nil
+}
+
+// Lock s only if it is free
+func TryLock(ctx context.Context, s string) (*string, error) {
+	tabmux.Lock()
+	defer tabmux.Unlock()
+	if l := tab[s]; l != nil {
+		return nil, fmt.Errorf("lock %s is held by %s", s, l.owner)
+	}
+	tab[s] = &lock{ownerOf(ctx), time.Now(), make(chan struct{}), map[*waiter]bool{}}
 	return &s, nil
 }
 
 func Unlock(s *string) {
 	tabmux.Lock()
 	defer tabmux.Unlock()
-	delete(tab, *s)
-	tabcond.Broadcast()
+	if l := tab[*s]; l != nil {
+		close(l.done)
+		delete(tab, *s)
+	}
+}
+
+type Holder struct {
+	Owner string
+	Since time.Time
+}
+
+type Info struct {
+	Name    string
+	Holder           // who holds the lock
+	Waiters []Holder // who waits for it, longest waiting first
+}
+
+// Return the locks held, sorted by name
+func Locks() []Info {
+	tabmux.Lock()
+	defer tabmux.Unlock()
+	ret := make([]Info, 0, len(tab))
+	for name, l := range tab {
+		info := Info{Name: name, Holder: Holder{l.owner, l.since}}
+		for w := range l.waiter {
+			info.Waiters = append(info.Waiters, Holder{w.owner, w.since})
+		}
+		sort.Slice(info.Waiters, func(i, j int) bool {
+			return info.Waiters[i].Since.Before(info.Waiters[j].Since)
+		})
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
 }
 
 func Test() {
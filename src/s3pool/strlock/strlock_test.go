@@ -0,0 +1,123 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package strlock
+
+import (
+	"context"
+	"s3pool/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTryLock(t *testing.T) {
+	ctx := WithOwner(context.Background(), "alice")
+	key, err := TryLock(ctx, "b:try")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = TryLock(WithOwner(context.Background(), "bob"), "b:try")
+	if err == nil || !strings.Contains(err.Error(), "held by alice") {
+		t.Errorf("second TryLock returned %v", err)
+	}
+	Unlock(key)
+	key, err = TryLock(ctx, "b:try")
+	if err != nil {
+		t.Fatalf("TryLock after Unlock: %v", err)
+	}
+	Unlock(key)
+}
+
+func TestLockWaits(t *testing.T) {
+	key, err := Lock("b:wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan error)
+	go func() {
+		key, err := LockContext(WithOwner(context.Background(), "bob"), "b:wait")
+		if err == nil {
+			Unlock(key)
+		}
+		got <- err
+	}()
+
+	// wait for bob to show up as a waiter
+	for i := 0; ; i++ {
+		locks := Locks()
+		if len(locks) == 1 && len(locks[0].Waiters) == 1 {
+			if owner := locks[0].Waiters[0].Owner; owner != "bob" {
+				t.Errorf("waiter is %s, want bob", owner)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("waiter not listed by Locks")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Unlock(key)
+	if err := <-got; err != nil {
+		t.Errorf("waiter failed: %v", err)
+	}
+	if locks := Locks(); len(locks) != 0 {
+		t.Errorf("%d locks left", len(locks))
+	}
+}
+
+func TestLockCanceled(t *testing.T) {
+	key, _ := Lock("b:cancel")
+	defer Unlock(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := LockContext(ctx, "b:cancel")
+	if err == nil || !strings.HasPrefix(err.Error(), "canceled") {
+		t.Errorf("LockContext returned %v, want canceled", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	save := conf.LockTimeout
+	conf.LockTimeout = 1
+	defer func() { conf.LockTimeout = save }()
+
+	key, _ := Lock("b:timeout")
+	defer Unlock(key)
+	_, err := LockContext(context.Background(), "b:timeout")
+	if err == nil || !strings.HasPrefix(err.Error(), "timed out") {
+		t.Errorf("LockContext returned %v, want timed out", err)
+	}
+	if locks := Locks(); len(locks) != 1 || len(locks[0].Waiters) != 0 {
+		t.Errorf("waiter left behind: %+v", locks)
+	}
+}
+
+func TestLockOutlastsTimeout(t *testing.T) {
+	if conf.LockTimeout != 0 {
+		t.Fatalf("lock_timeout defaults to %d, want 0", conf.LockTimeout)
+	}
+
+	// a healthy holder that runs longer than a lock_timeout would allow
+	key, _ := Lock("b:long")
+	time.AfterFunc(1500*time.Millisecond, func() { Unlock(key) })
+	start := time.Now()
+	key2, err := LockContext(context.Background(), "b:long")
+	if err != nil {
+		t.Fatalf("waiter failed with lock_timeout off: %v", err)
+	}
+	Unlock(key2)
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("waiter got the lock after %v, before the holder was done", waited)
+	}
+}
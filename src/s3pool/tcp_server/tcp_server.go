@@ -18,6 +18,7 @@ import (
 	"net"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -33,6 +34,9 @@ type server struct {
 	address  string // Address to open connection: localhost:9999
 	listener net.Listener
 	callback func(c *Client, message string)
+	mux      sync.Mutex     // protects closed and the adds to active
+	closed   bool           // no more accepts
+	active   sync.WaitGroup // requests in progress
 }
 
 // Read client data from channel
@@ -43,6 +47,16 @@ func (c *Client) accepted() {
 	req = strings.Trim(req, " \n\t\r")
 	c.Server.callback(c, req)
 	c.conn.Close()
+	c.Server.active.Done()
+}
+
+// Return the host address of the client, without the port
+func (c *Client) RemoteHost() string {
+	addr := c.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
 }
 
 // Send text message to client
@@ -68,7 +82,23 @@ func (s *server) Loop() error {
 	defer s.listener.Close()
 
 	for {
-		conn, _ := s.listener.Accept()
+		conn, err := s.listener.Accept()
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			s.mux.Unlock()
+			log.Println("Accept() failed -", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.active.Add(1)
+		s.mux.Unlock()
 		//syscall.SetsockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
 		client := &Client{
 			conn:   conn,
@@ -79,6 +109,30 @@ func (s *server) Loop() error {
 	return nil
 }
 
+// Stop accepting connections; Loop returns
+func (s *server) Close() error {
+	s.mux.Lock()
+	s.closed = true
+	s.mux.Unlock()
+	return s.listener.Close()
+}
+
+// Wait up to timeout for the requests in progress to finish. Returns
+// false on timeout.
+func (s *server) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // Creates new tcp server instance
 func New(address string, callback func(c *Client, message string)) (*server, error) {
 	log.Println("Starting server at", address)
@@ -0,0 +1,237 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package verify
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"s3pool/conf"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A download is checked against the checksum that the backend keeps
+// for the object before it is moved into data/. One that does not
+// match is moved to QUARANTINEDIR for inspection, and the download
+// fails with a "checksum mismatch" error, which is worth another try.
+// Only the latest copy of each key is kept there, and the oldest copies
+// go once they take more than QUARANTINEMAXBYTES. The digest verified
+// is recorded in the meta file as algo:value.
+
+const QUARANTINEDIR = "quarantine"
+const QUARANTINEMAXBYTES = 1 << 30
+
+var quarantineMux sync.Mutex
+
+type MismatchError struct {
+	Name string // bucket:key
+	Algo string
+	Want string
+	Got  string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch on %s -- %s is %s, expected %s", e.Name, e.Algo, e.Got, e.Want)
+}
+
+// Return the size of the file at path
+func Size(path string) (int64, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func sum(path string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Return the MD5 of the file at path in hex
+func MD5(path string) (string, error) {
+	b, err := sum(path, md5.New())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Return the CRC32C of the file at path
+func CRC32C(path string) (uint32, error) {
+	b, err := sum(path, crc32.New(crc32.MakeTable(crc32.Castagnoli)))
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Return the MD5MD5CRC32 checksum that HDFS keeps for the file at path
+// in hex: the MD5 of the MD5s of each block, where the MD5 of a block
+// is that of the CRCs of each bytesPerCRC bytes in it. castagnoli picks
+// CRC32C over CRC32.
+func HdfsMD5(path string, blockSize int64, bytesPerCRC int, castagnoli bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	table := crc32.IEEETable
+	if castagnoli {
+		table = crc32.MakeTable(crc32.Castagnoli)
+	}
+	var md5s []byte
+	buf := make([]byte, bytesPerCRC)
+	crc := make([]byte, 4)
+	for eof := false; !eof; {
+		h := md5.New()
+		var n int64
+		for n < blockSize {
+			k, err := io.ReadFull(f, buf)
+			if k > 0 {
+				binary.BigEndian.PutUint32(crc, crc32.Checksum(buf[:k], table))
+				h.Write(crc)
+				n += int64(k)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		if n > 0 {
+			md5s = h.Sum(md5s)
+		}
+	}
+
+	// HDFS takes the MD5 of the whole buffer that the block MD5s are
+	// written to, whose size starts at 32 bytes and doubles as needed
+	padded := 32
+	for padded < len(md5s) {
+		padded *= 2
+	}
+	b := md5.Sum(append(md5s, make([]byte, padded-len(md5s))...))
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Parse algo, the name of the checksum that hadoop fs -checksum
+// reports for a file, of the form
+//
+//	MD5-of-<crcPerBlock>MD5-of-<bytesPerCRC>CRC32C
+//
+// into the block size and bytes per CRC that HdfsMD5 needs, and whether
+// the CRC is a CRC32C. crcPerBlock is 0 for a file of one block. ok is
+// false for a checksum of another form, such as COMPOSITE-CRC32C.
+func ParseHdfsChecksum(algo string) (blockSize int64, bytesPerCRC int, castagnoli bool, ok bool) {
+	var crcPerBlock int64
+	var crcname string
+	n, _ := fmt.Sscanf(strings.Replace(algo, "MD5-of-", " ", -1), "%d %d%s", &crcPerBlock, &bytesPerCRC, &crcname)
+	if n != 3 || bytesPerCRC <= 0 || crcPerBlock < 0 || (crcname != "CRC32" && crcname != "CRC32C") {
+		return 0, 0, false, false
+	}
+	blockSize = crcPerBlock * int64(bytesPerCRC)
+	if blockSize == 0 {
+		blockSize = 1 << 62
+	}
+	return blockSize, bytesPerCRC, crcname == "CRC32C", true
+}
+
+// Compare the digest got of the download at path of bucket:key with
+// want. On a mismatch, the download is quarantined and a
+// *MismatchError returned.
+func Match(bucket, key, path, algo, want, got string) error {
+	if strings.EqualFold(want, got) {
+		return nil
+	}
+	merr := &MismatchError{bucket + ":" + key, algo, want, got}
+	log.Println(merr)
+	if err := quarantine(bucket, key, path); err != nil {
+		log.Printf("cannot quarantine %s -- %v\n", path, err)
+		os.Remove(path)
+	}
+	return merr
+}
+
+func quarantine(bucket, key, path string) error {
+	size, err := Size(path)
+	if err != nil {
+		return err
+	}
+	if size > QUARANTINEMAXBYTES {
+		return fmt.Errorf("%d bytes is over the quarantine limit", size)
+	}
+
+	quarantineMux.Lock()
+	defer quarantineMux.Unlock()
+	dst := filepath.Join(QUARANTINEDIR, bucket, key)
+	os.Remove(dst)
+	makeRoom(QUARANTINEMAXBYTES - size)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	conf.CountQuarantine++
+	log.Printf("quarantined %s:%s to %s\n", bucket, key, dst)
+	return nil
+}
+
+// Remove the oldest files in QUARANTINEDIR until they take at most
+// nbytes. Caller should hold quarantineMux.
+func makeRoom(nbytes int64) {
+	type file struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []file
+	var total int64
+	filepath.Walk(QUARANTINEDIR, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, file{path, fi.Size(), fi.ModTime()})
+			total += fi.Size()
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		if total <= nbytes {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			log.Printf("removed %s from quarantine\n", f.path)
+			total -= f.size
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package verify
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write data to a file in a temp dir and return its path
+func tempFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The MD5MD5CRC32 of blocks, each given as its chunks of bytesPerCRC
+// bytes, with the MD5s padded to 32 or 64 bytes
+func md5md5crc(blocks [][]string, table *crc32.Table, padded int) string {
+	var md5s []byte
+	for _, chunks := range blocks {
+		h := md5.New()
+		for _, c := range chunks {
+			crc := make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte(c), table))
+			h.Write(crc)
+		}
+		md5s = h.Sum(md5s)
+	}
+	b := md5.Sum(append(md5s, make([]byte, padded-len(md5s))...))
+	return hex.EncodeToString(b[:])
+}
+
+func TestHdfsMD5(t *testing.T) {
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	for _, c := range []struct {
+		data       string
+		blockSize  int64
+		castagnoli bool
+		want       string
+	}{
+		// what hadoop fs -checksum reports for an empty file
+		{"", 8, true, "70bc8f4b72a86921468bf8e8441dce51"},
+		{"hello world", 1 << 62, true,
+			md5md5crc([][]string{{"hell", "o wo", "rld"}}, castagnoli, 32)},
+		{"hello world", 1 << 62, false,
+			md5md5crc([][]string{{"hell", "o wo", "rld"}}, crc32.IEEETable, 32)},
+		{"hello world", 8, true,
+			md5md5crc([][]string{{"hell", "o wo"}, {"rld"}}, castagnoli, 32)},
+		// three block MD5s take 48 bytes, padded to 64
+		{"hello world!", 4, true,
+			md5md5crc([][]string{{"hell"}, {"o wo"}, {"rld!"}}, castagnoli, 64)},
+	} {
+		got, err := HdfsMD5(tempFile(t, c.data), c.blockSize, 4, c.castagnoli)
+		if err != nil || got != c.want {
+			t.Errorf("HdfsMD5(%q, %d, 4, %v) = %s, %v; want %s",
+				c.data, c.blockSize, c.castagnoli, got, err, c.want)
+		}
+	}
+}
+
+func TestParseHdfsChecksum(t *testing.T) {
+	for _, c := range []struct {
+		algo        string
+		blockSize   int64
+		bytesPerCRC int
+		castagnoli  bool
+		ok          bool
+	}{
+		{"MD5-of-262144MD5-of-512CRC32C", 128 << 20, 512, true, true},
+		{"MD5-of-131072MD5-of-1024CRC32", 128 << 20, 1024, false, true},
+		{"MD5-of-0MD5-of-512CRC32C", 1 << 62, 512, true, true},
+		{"COMPOSITE-CRC32C", 0, 0, false, false},
+		{"MD5-of-0MD5-of-512ADLER32", 0, 0, false, false},
+		{"MD5-of-0MD5-of-0CRC32C", 0, 0, false, false},
+	} {
+		blockSize, bytesPerCRC, castagnoli, ok := ParseHdfsChecksum(c.algo)
+		if blockSize != c.blockSize || bytesPerCRC != c.bytesPerCRC || castagnoli != c.castagnoli || ok != c.ok {
+			t.Errorf("ParseHdfsChecksum(%q) = %d, %d, %v, %v", c.algo, blockSize, bytesPerCRC, castagnoli, ok)
+		}
+	}
+}
+
+// Run the test in a temp dir so that QUARANTINEDIR is under it
+func chdir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestMatch(t *testing.T) {
+	chdir(t)
+	if err := Match("b", "k", "nosuch", "md5", "ABC", "abc"); err != nil {
+		t.Errorf("Match of equal digests returned %v", err)
+	}
+
+	// only the latest copy of a key is kept
+	for _, data := range []string{"first", "second"} {
+		err := Match("b", "dir/k", tempFile(t, data), "md5", "abc", "def")
+		if _, ok := err.(*MismatchError); !ok {
+			t.Fatalf("Match returned %v, want a *MismatchError", err)
+		}
+	}
+	byt, err := ioutil.ReadFile(filepath.Join(QUARANTINEDIR, "b", "dir", "k"))
+	if err != nil || string(byt) != "second" {
+		t.Errorf("quarantine holds %q, %v; want second", byt, err)
+	}
+}
+
+func TestMakeRoom(t *testing.T) {
+	chdir(t)
+	os.MkdirAll(QUARANTINEDIR, 0755)
+	now := time.Now()
+	for i, name := range []string{"old", "mid", "new"} {
+		path := filepath.Join(QUARANTINEDIR, name)
+		ioutil.WriteFile(path, make([]byte, 100), 0644)
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	makeRoom(150)
+	for name, want := range map[string]bool{"old": false, "mid": false, "new": true} {
+		_, err := os.Stat(filepath.Join(QUARANTINEDIR, name))
+		if (err == nil) != want {
+			t.Errorf("%s kept is %v, want %v", name, err == nil, want)
+		}
+	}
+}
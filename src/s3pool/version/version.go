@@ -0,0 +1,124 @@
+/*
+ *  S3pool - S3 cache on local disk
+ *  Copyright (c) 2019 CK Tan
+ *  cktanx@gmail.com
+ *
+ *  S3Pool can be used for free under the GNU General Public License
+ *  version 3, where anything released into public must be open source,
+ *  or under a commercial license. The commercial license does not
+ *  cover derived or ported versions created by third parties under
+ *  GPL. To inquire about commercial license, please send email to
+ *  cktanx@gmail.com.
+ */
+package version
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"s3pool/conf"
+	"s3pool/proc"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The backends other than s3 and gohdfs have no ETag of their own. The
+// etag of an object is made up from what changes when its content
+// does, and must be the same whether it comes from the listing of a
+// bucket or from the object itself, so that a cached object is only
+// fetched again when it has changed.
+
+// Return the etag of a local file: inode, size and modification time
+func Local(fi os.FileInfo) string {
+	var ino uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = uint64(st.Ino)
+	}
+	return fmt.Sprintf("%x-%x-%x", ino, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// Return the etags of the hdfs files at paths of bucket, in the same
+// order: their length and modification time from hadoop fs -stat. The
+// etag of a file that is gone, as when it was deleted after a listing,
+// is "".
+func Hdfs(ctx context.Context, bucket string, paths []string) ([]string, error) {
+	var outbuf, errbuf bytes.Buffer
+	args := append([]string{"fs"}, conf.HadoopOptions(bucket)...)
+	args = append(args, "-stat", "%b %Y %n")
+	cmd := proc.Command(ctx, "hadoop", append(args, paths...)...)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	runErr := cmd.Run()
+	if runErr != nil {
+		if terr := proc.Err(ctx, "hadoop fs -stat"); terr != nil {
+			return nil, terr
+		}
+	}
+
+	// hadoop fs -stat prints a line for each file it finds, in order,
+	// and complains of the others on stderr
+	var lines []string
+	if out := strings.TrimRight(outbuf.String(), "\n"); out != "" {
+		lines = strings.Split(out, "\n")
+	}
+	etags := make([]string, len(paths))
+	gone := 0
+	for i, p := range paths {
+		if len(lines) > 0 {
+			if etag, name, err := hdfsStat(lines[0]); err != nil {
+				return nil, err
+			} else if name == path.Base(p) {
+				etags[i] = etag
+				lines = lines[1:]
+				continue
+			}
+		}
+		gone++
+	}
+	if len(lines) > 0 || (runErr == nil && gone > 0) {
+		return nil, fmt.Errorf("hadoop fs -stat output format error")
+	}
+	if runErr != nil && (gone == 0 || gone != strings.Count(errbuf.String(), "No such file or directory")) {
+		return nil, fmt.Errorf("hadoop fs -stat failed -- %s", errbuf.String())
+	}
+	return etags, nil
+}
+
+// Return the etag of the hdfs file at dfspath of bucket
+func HdfsFile(ctx context.Context, bucket, dfspath string) (string, error) {
+	etags, err := Hdfs(ctx, bucket, []string{dfspath})
+	if err != nil {
+		return "", err
+	}
+	if etags[0] == "" {
+		return "", fmt.Errorf("hadoop fs -stat failed -- %s: No such file or directory", dfspath)
+	}
+	return etags[0], nil
+}
+
+// Parse a line of hadoop fs -stat "%b %Y %n" into the etag and the
+// name of the file
+func hdfsStat(line string) (etag, name string, err error) {
+	f := strings.SplitN(line, " ", 3)
+	if len(f) != 3 {
+		return "", "", fmt.Errorf("hadoop fs -stat output format error")
+	}
+	size, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("hadoop fs -stat output format error")
+	}
+	mtime, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("hadoop fs -stat output format error")
+	}
+	return fmt.Sprintf("%x-%x", size, mtime), f[2], nil
+}
+
+// Return the etag of a gcs object: its generation, which changes
+// whenever the object is written
+func Gcs(generation int64) string {
+	return strconv.FormatInt(generation, 10)
+}